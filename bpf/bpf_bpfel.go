@@ -28,9 +28,9 @@ func loadBpf() (*ebpf.CollectionSpec, error) {
 //
 // The following types are suitable as obj argument:
 //
-//     *bpfObjects
-//     *bpfPrograms
-//     *bpfMaps
+//	*bpfObjects
+//	*bpfPrograms
+//	*bpfMaps
 //
 // See ebpf.CollectionSpec.LoadAndAssign documentation for details.
 func loadBpfObjects(obj interface{}, opts *ebpf.CollectionOptions) error {
@@ -54,16 +54,32 @@ type bpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfProgramSpecs struct {
-	XdpProgMain *ebpf.ProgramSpec `ebpf:"xdp_prog_main"`
+	TcProgMain   *ebpf.ProgramSpec `ebpf:"tc_prog_main"`
+	TcProgMainL3 *ebpf.ProgramSpec `ebpf:"tc_prog_main_l3"`
+	XdpProgMain  *ebpf.ProgramSpec `ebpf:"xdp_prog_main"`
 }
 
 // bpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	IpBlockedMap             *ebpf.MapSpec `ebpf:"ip_blocked_map"`
-	IpMetricMap              *ebpf.MapSpec `ebpf:"ip_metric_map"`
-	TcpConnectionTrackingMap *ebpf.MapSpec `ebpf:"tcp_connection_tracking_map"`
+	BanInfoMap             *ebpf.MapSpec `ebpf:"ban_info_map"`
+	ConfigMap              *ebpf.MapSpec `ebpf:"config_map"`
+	IpAllowedMap           *ebpf.MapSpec `ebpf:"ip_allowed_map"`
+	IpBlockedMap           *ebpf.MapSpec `ebpf:"ip_blocked_map"`
+	IpDeniedMap            *ebpf.MapSpec `ebpf:"ip_denied_map"`
+	IpMetricMap            *ebpf.MapSpec `ebpf:"ip_metric_map"`
+	IpMetricScratchMap     *ebpf.MapSpec `ebpf:"ip_metric_scratch_map"`
+	LocalIpMap             *ebpf.MapSpec `ebpf:"local_ip_map"`
+	PortScanMap            *ebpf.MapSpec `ebpf:"port_scan_map"`
+	SweepMap               *ebpf.MapSpec `ebpf:"sweep_map"`
+	SynBucketMap           *ebpf.MapSpec `ebpf:"syn_bucket_map"`
+	SynDroppedMap          *ebpf.MapSpec `ebpf:"syn_dropped_map"`
+	TcpConnectionLostMap   *ebpf.MapSpec `ebpf:"tcp_connection_lost_map"`
+	TcpConnectionPerfArray *ebpf.MapSpec `ebpf:"tcp_connection_perf_array"`
+	TcpConnectionRingbuf   *ebpf.MapSpec `ebpf:"tcp_connection_ringbuf"`
+	TcpFlowMap             *ebpf.MapSpec `ebpf:"tcp_flow_map"`
+	VlanThresholdMap       *ebpf.MapSpec `ebpf:"vlan_threshold_map"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -85,16 +101,44 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	IpBlockedMap             *ebpf.Map `ebpf:"ip_blocked_map"`
-	IpMetricMap              *ebpf.Map `ebpf:"ip_metric_map"`
-	TcpConnectionTrackingMap *ebpf.Map `ebpf:"tcp_connection_tracking_map"`
+	BanInfoMap             *ebpf.Map `ebpf:"ban_info_map"`
+	ConfigMap              *ebpf.Map `ebpf:"config_map"`
+	IpAllowedMap           *ebpf.Map `ebpf:"ip_allowed_map"`
+	IpBlockedMap           *ebpf.Map `ebpf:"ip_blocked_map"`
+	IpDeniedMap            *ebpf.Map `ebpf:"ip_denied_map"`
+	IpMetricMap            *ebpf.Map `ebpf:"ip_metric_map"`
+	IpMetricScratchMap     *ebpf.Map `ebpf:"ip_metric_scratch_map"`
+	LocalIpMap             *ebpf.Map `ebpf:"local_ip_map"`
+	PortScanMap            *ebpf.Map `ebpf:"port_scan_map"`
+	SweepMap               *ebpf.Map `ebpf:"sweep_map"`
+	SynBucketMap           *ebpf.Map `ebpf:"syn_bucket_map"`
+	SynDroppedMap          *ebpf.Map `ebpf:"syn_dropped_map"`
+	TcpConnectionLostMap   *ebpf.Map `ebpf:"tcp_connection_lost_map"`
+	TcpConnectionPerfArray *ebpf.Map `ebpf:"tcp_connection_perf_array"`
+	TcpConnectionRingbuf   *ebpf.Map `ebpf:"tcp_connection_ringbuf"`
+	TcpFlowMap             *ebpf.Map `ebpf:"tcp_flow_map"`
+	VlanThresholdMap       *ebpf.Map `ebpf:"vlan_threshold_map"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
+		m.BanInfoMap,
+		m.ConfigMap,
+		m.IpAllowedMap,
 		m.IpBlockedMap,
+		m.IpDeniedMap,
 		m.IpMetricMap,
-		m.TcpConnectionTrackingMap,
+		m.IpMetricScratchMap,
+		m.LocalIpMap,
+		m.PortScanMap,
+		m.SweepMap,
+		m.SynBucketMap,
+		m.SynDroppedMap,
+		m.TcpConnectionLostMap,
+		m.TcpConnectionPerfArray,
+		m.TcpConnectionRingbuf,
+		m.TcpFlowMap,
+		m.VlanThresholdMap,
 	)
 }
 
@@ -102,11 +146,15 @@ func (m *bpfMaps) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfPrograms struct {
-	XdpProgMain *ebpf.Program `ebpf:"xdp_prog_main"`
+	TcProgMain   *ebpf.Program `ebpf:"tc_prog_main"`
+	TcProgMainL3 *ebpf.Program `ebpf:"tc_prog_main_l3"`
+	XdpProgMain  *ebpf.Program `ebpf:"xdp_prog_main"`
 }
 
 func (p *bpfPrograms) Close() error {
 	return _BpfClose(
+		p.TcProgMain,
+		p.TcProgMainL3,
 		p.XdpProgMain,
 	)
 }
@@ -121,5 +169,6 @@ func _BpfClose(closers ...io.Closer) error {
 }
 
 // Do not access this directly.
+//
 //go:embed bpf_bpfel.o
 var _BpfBytes []byte
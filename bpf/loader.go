@@ -1,11 +1,20 @@
 package bpf
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/rlimit"
+	"inet.af/netaddr"
 )
 
 // Note: include is hardcoded to x86_64, this could be changed via Makefile to support arm64
@@ -13,29 +22,389 @@ import (
 // https://github.com/cilium/cilium/commit/8b3435f91af72dfbc2eef13f463b95ec08faec55
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc $BPF_CLANG -cflags $BPF_CFLAGS bpf xdp.c -- -I/usr/include/x86_64-linux-gnu
 
-// LoadAndAttach loads the eBPF XDP program with it maps and attaches them to the given interface.
-func LoadAndAttach(iface int) (*ebpf.Map, *ebpf.Map, *ebpf.Map) {
+// Maps are the BPF maps userspace uses to communicate with the XDP program, see types.h for their layout.
+type Maps struct {
+	Connections     *ebpf.Map // tcp_connection_ringbuf, or tcp_connection_perf_array on kernels without ring buffers
+	LostConnections *ebpf.Map // tcp_connection_lost_map
+	Metric          *ebpf.Map // ip_metric_map
+	Blocking        *ebpf.Map // ip_blocked_map
+	BanInfo         *ebpf.Map // ban_info_map
+	Denied          *ebpf.Map // ip_denied_map
+	Config          *ebpf.Map // config_map
+	VLANThresholds  *ebpf.Map // vlan_threshold_map
+	SYNDropped      *ebpf.Map // syn_dropped_map
+	Sweep           *ebpf.Map // sweep_map
+	LocalIPs        *ebpf.Map // local_ip_map
+}
+
+// pinnedMaps are the maps pinned in the pin path, so bans, metrics and connections not read yet survive restarts.
+var pinnedMaps = []string{"ip_blocked_map", "ban_info_map", "ip_metric_map", "tcp_connection_ringbuf"}
+
+// xdpLinkPrefix is the prefix of the pinned XDP links in the pin path, followed by the interface name.
+const xdpLinkPrefix = "xdp_link_"
+
+// LoaderOptions configures how the programs are loaded and attached.
+type LoaderOptions struct {
+	// Allowlist contains the IPs the XDP program never drops
+	Allowlist *netaddr.IPSet
+	// PinPath is a bpffs directory where the maps listed in pinnedMaps and the XDP links are pinned and reused on the
+	// next start, pinning is disabled if empty. The pinned XDP links keep the program attached while the daemon is not
+	// running.
+	PinPath string
+	// Hook is where the program is attached, XDP or TC ingress
+	Hook Hook
+	// XDPMode is the attach mode of the XDP program, ignored with the TC hook
+	XDPMode XDPMode
+}
+
+// Loader owns the BPF objects and the attachments to the interfaces, Close detaches the program and releases them.
+type Loader struct {
+	objs    bpfObjects
+	options LoaderOptions
+	mutex   sync.Mutex
+	// attachments are indexed by interface name
+	attachments map[string]attachment
+	maps        *Maps
+}
+
+// attachment is the program attached to an interface, either through an XDP link or a TC filter.
+type attachment interface {
+	// mode is reported in the teleportchallenge_program_attached gauge
+	mode() string
+	// detach removes the program from the interface, even if it is persistent
+	detach() error
+	// close releases the attachment, persistent attachments keep the program attached
+	close() error
+}
+
+// xdpAttachment is the XDP link of an interface and the mode it was attached in.
+type xdpAttachment struct {
+	link    link.Link
+	xdpMode XDPMode
+	pinned  bool
+}
+
+func (a *xdpAttachment) mode() string {
+	return string(a.xdpMode)
+}
+
+func (a *xdpAttachment) detach() error {
+	if a.pinned {
+		if err := a.link.Unpin(); err != nil {
+			_ = a.link.Close()
+			return fmt.Errorf("unpinning XDP link: %w", err)
+		}
+	}
+	return a.link.Close()
+}
+
+func (a *xdpAttachment) close() error {
+	return a.link.Close()
+}
+
+// LoadAndAttach loads the eBPF programs with their maps and attaches them to the given interfaces. The interfaces
+// share the same maps, so an IP blocked on one of them is blocked on all of them.
+func LoadAndAttach(ifaces []net.Interface, options LoaderOptions) (*Loader, error) {
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("removing memlock limit: %w", err)
+	}
+
+	spec, err := loadBpf()
+	if err != nil {
+		return nil, fmt.Errorf("loading BPF spec: %w", err)
 	}
 
-	objs := bpfObjects{}
-	if err := loadBpfObjects(&objs, nil); err != nil {
-		log.Fatalf("Error loading BPF objects: %v", err)
+	useRingbuf, err := configureConnectionStream(spec)
+	if err != nil {
+		return nil, fmt.Errorf("configuring the connection stream: %w", err)
+	}
+
+	l := &Loader{
+		options:     options,
+		attachments: make(map[string]attachment),
+	}
+	if err := loadObjects(spec, &l.objs, options.PinPath); err != nil {
+		return nil, fmt.Errorf("loading BPF objects: %w", err)
 	}
 
 	log.Println("BPF objects loaded")
 
-	if _, err := link.AttachXDP(link.XDPOptions{
-		Program:   objs.XdpProgMain,
-		Interface: iface,
-		Flags:     0,
-	}); err != nil {
-		log.Fatalf("Error attaching XDP program: %v", err)
+	if err := allowPrefixes(l.objs.IpAllowedMap, options.Allowlist.Prefixes()); err != nil {
+		_ = l.objs.Close()
+		return nil, fmt.Errorf("loading the allowlist: %w", err)
+	}
+
+	for _, iface := range ifaces {
+		if err := l.Attach(iface); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	connections := l.objs.TcpConnectionRingbuf
+	if !useRingbuf {
+		connections = l.objs.TcpConnectionPerfArray
+	}
+
+	l.maps = &Maps{
+		Connections:     connections,
+		LostConnections: l.objs.TcpConnectionLostMap,
+		Metric:          l.objs.IpMetricMap,
+		Blocking:        l.objs.IpBlockedMap,
+		BanInfo:         l.objs.BanInfoMap,
+		Denied:          l.objs.IpDeniedMap,
+		Config:          l.objs.ConfigMap,
+		VLANThresholds:  l.objs.VlanThresholdMap,
+		SYNDropped:      l.objs.SynDroppedMap,
+		Sweep:           l.objs.SweepMap,
+		LocalIPs:        l.objs.LocalIpMap,
+	}
+	return l, nil
+}
+
+// Maps returns the BPF maps shared with the programs. They must not be used after Close.
+func (l *Loader) Maps() *Maps {
+	return l.maps
+}
+
+// Attach attaches the program to an interface, on the configured hook.
+func (l *Loader) Attach(iface net.Interface) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var a attachment
+	var err error
+	if l.options.Hook == HookTC {
+		a, err = attachTC(l.objs.TcProgMain, l.objs.TcProgMainL3, iface, l.options.PinPath != "")
+	} else {
+		a, err = attachXDP(l.objs.XdpProgMain, iface, l.options.PinPath, l.options.XDPMode)
+	}
+	if err != nil {
+		return fmt.Errorf("attaching %s program to %s: %w", l.options.Hook, iface.Name, err)
+	}
+	l.attachments[iface.Name] = a
+	programAttached.WithLabelValues(iface.Name, a.mode()).Set(1)
+	return nil
+}
+
+// Detach detaches the program from an interface, removing its pinned link or TC filter if any. Detaching from an
+// interface that was deleted only releases the attachment.
+func (l *Loader) Detach(name string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	a, ok := l.attachments[name]
+	if !ok {
+		return nil
+	}
+	delete(l.attachments, name)
+	programAttached.DeleteLabelValues(name, a.mode())
+	if err := a.detach(); err != nil {
+		return fmt.Errorf("detaching %s program from %s: %w", l.options.Hook, name, err)
+	}
+	return nil
+}
+
+// Close detaches the program from every interface, unless its attachment is persistent, and closes the BPF objects.
+func (l *Loader) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var errs []error
+	for name, a := range l.attachments {
+		if err := a.close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing %s attachment of %s: %w", l.options.Hook, name, err))
+		}
+	}
+	if err := l.objs.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return joinErrors(errs)
+	}
+	log.Println("BPF objects closed")
+	return nil
+}
+
+// joinErrors returns an error listing all the given errors, which can be unwrapped to the first one.
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	messages := make([]string, 0, len(errs)-1)
+	for _, err := range errs[1:] {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%w; %s", errs[0], strings.Join(messages, "; "))
+}
+
+// configureConnectionStream makes the XDP program stream connections through the perf event array when the kernel
+// does not support ring buffers (Linux < 5.8). It returns whether the ring buffer is used.
+func configureConnectionStream(spec *ebpf.CollectionSpec) (bool, error) {
+	err := features.HaveMapType(ebpf.RingBuf)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, ebpf.ErrNotSupported) {
+		return false, err
+	}
+
+	log.Println("Ring buffers are not supported by the kernel, falling back on perf event array")
+	if err := spec.RewriteConstants(map[string]interface{}{"use_ringbuf": uint8(0)}); err != nil {
+		return false, err
+	}
+	// The ring buffer cannot be created on this kernel, we replace it with a placeholder the verifier will prune
+	// along with the code using it.
+	spec.Maps["tcp_connection_ringbuf"] = &ebpf.MapSpec{
+		Name:       "tcp_connection_ringbuf",
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	return false, nil
+}
+
+// loadObjects loads the BPF objects, reusing the maps pinned in pinPath if it is set. Pinned maps whose layout is not
+// compatible anymore, for example after an upgrade changing their size, are replaced.
+func loadObjects(spec *ebpf.CollectionSpec, objs *bpfObjects, pinPath string) error {
+	if pinPath == "" {
+		return spec.LoadAndAssign(objs, nil)
+	}
+
+	if err := os.MkdirAll(pinPath, 0700); err != nil {
+		return err
+	}
+	for _, name := range pinnedMaps {
+		// The ring buffer is replaced by a placeholder on kernels without ring buffers
+		if mapSpec, ok := spec.Maps[name]; ok && mapSpec.Type != ebpf.Array {
+			mapSpec.Pinning = ebpf.PinByName
+		}
+	}
+	opts := &ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: pinPath},
 	}
 
-	log.Println("XDP program attached")
+	err := spec.LoadAndAssign(objs, opts)
+	if !errors.Is(err, ebpf.ErrMapIncompatible) {
+		return err
+	}
+	log.Printf("Pinned maps are incompatible with this version, replacing them: %v", err)
+	for _, name := range pinnedMaps {
+		if err := os.Remove(filepath.Join(pinPath, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return spec.LoadAndAssign(objs, opts)
+}
 
-	return objs.TcpConnectionTrackingMap, objs.IpMetricMap, objs.IpBlockedMap
+// attachXDP attaches the XDP program to the interface. If pinPath is set, the XDP link is pinned and an existing
+// pinned link is updated to run the new program, so packets are filtered without interruption during upgrades.
+// Updated links keep the mode they were attached in, unless it differs from the requested one: the link is then
+// replaced, which leaves the interface unfiltered for a moment.
+func attachXDP(program *ebpf.Program, iface net.Interface, pinPath string, mode XDPMode) (*xdpAttachment, error) {
+	options := link.XDPOptions{
+		Program:   program,
+		Interface: iface.Index,
+	}
+	if pinPath == "" {
+		xdpLink, mode, err := attachXDPMode(options, mode, iface.Name)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("XDP program attached to %s in %s mode", iface.Name, mode)
+		return &xdpAttachment{link: xdpLink, xdpMode: mode}, nil
+	}
+
+	linkPath := filepath.Join(pinPath, xdpLinkPrefix+iface.Name)
+	if _, err := os.Stat(linkPath); err == nil {
+		xdpLink, err := updatePinnedLink(linkPath, program, iface.Index)
+		if err != nil {
+			return nil, err
+		}
+		if xdpLink != nil {
+			attachment := &xdpAttachment{link: xdpLink, xdpMode: attachedXDPMode(iface.Index), pinned: true}
+			if xdpModeMatches(mode, attachment.xdpMode) {
+				log.Printf("XDP program replaced in the pinned link of %s in %s mode", iface.Name, attachment.xdpMode)
+				return attachment, nil
+			}
+			log.Printf("Pinned XDP link of %s is in %s mode, attaching it again in %s mode", iface.Name,
+				attachment.xdpMode, mode)
+			if err := attachment.detach(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	xdpLink, mode, err := attachXDPMode(options, mode, iface.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := xdpLink.Pin(linkPath); err != nil {
+		_ = xdpLink.Close()
+		return nil, fmt.Errorf("pinning XDP link: %w", err)
+	}
+	log.Printf("XDP program attached to %s in %s mode and pinned", iface.Name, mode)
+	return &xdpAttachment{link: xdpLink, xdpMode: mode, pinned: true}, nil
+}
+
+// updatePinnedLink replaces the program of the XDP link pinned at linkPath and returns the link. If the link is
+// attached to another interface, for example because the interface was recreated, it is detached and
+// updatePinnedLink returns nil.
+func updatePinnedLink(linkPath string, program *ebpf.Program, iface int) (link.Link, error) {
+	xdpLink, err := link.LoadPinnedLink(linkPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := xdpLink.Info()
+	if err != nil {
+		_ = xdpLink.Close()
+		return nil, err
+	}
+	if xdpInfo := info.XDP(); xdpInfo == nil || int(xdpInfo.Ifindex) != iface {
+		log.Printf("Pinned XDP link %s is attached to another interface, detaching it", linkPath)
+		err := xdpLink.Unpin()
+		_ = xdpLink.Close()
+		return nil, err
+	}
+
+	if err := xdpLink.Update(program); err != nil {
+		_ = xdpLink.Close()
+		return nil, err
+	}
+	return xdpLink, nil
+}
+
+// LPMKey is the key of the LPM trie maps, see lpm_key in types.h.
+type LPMKey struct {
+	PrefixLen uint32
+	IP        [16]byte
+}
+
+// NewLPMKey converts a prefix into the key of a LPM trie map.
+// IPv4 prefixes are converted to IPv4-mapped IPv6 prefixes like the programs do with IPv4 addresses.
+func NewLPMKey(prefix netaddr.IPPrefix) LPMKey {
+	prefixLen := uint32(prefix.Bits())
+	if prefix.IP().Is4() {
+		prefixLen += 96
+	}
+	return LPMKey{
+		PrefixLen: prefixLen,
+		IP:        prefix.IP().As16(),
+	}
+}
+
+// allowPrefixes inserts the prefixes into the ip_allowed_map LPM trie.
+func allowPrefixes(allowedMap *ebpf.Map, prefixes []netaddr.IPPrefix) error {
+	for _, prefix := range prefixes {
+		if err := allowedMap.Put(NewLPMKey(prefix), uint8(1)); err != nil {
+			return err
+		}
+	}
+	if len(prefixes) > 0 {
+		log.Printf("%d prefixes allowlisted", len(prefixes))
+	}
+	return nil
 }
@@ -0,0 +1,20 @@
+package bpf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinErrors(t *testing.T) {
+	first := errors.New("closing xdp attachment of eth0: busy")
+	second := errors.New("closing xdp attachment of eth1: busy")
+	third := errors.New("map closed twice")
+
+	err := joinErrors([]error{first, second, third})
+
+	assert.EqualError(t, err, "closing xdp attachment of eth0: busy; closing xdp attachment of eth1: busy; map closed twice")
+	assert.ErrorIs(t, err, first)
+	assert.Equal(t, first, joinErrors([]error{first}))
+}
@@ -0,0 +1,16 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestObjectsMatchBindings makes sure the embedded objects were regenerated along with the bindings, otherwise the
+// loader fails at startup on the first missing map or program. Run `make bpf` after changing xdp.c or types.h.
+func TestObjectsMatchBindings(t *testing.T) {
+	spec, err := loadBpf()
+	require.NoError(t, err)
+	assert.NoError(t, spec.Assign(&bpfSpecs{}))
+}
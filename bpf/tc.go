@@ -0,0 +1,112 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+)
+
+// Hook is where the program is attached on an interface.
+type Hook string
+
+const (
+	// HookXDP attaches the XDP program, it runs as early as possible in the receive path
+	HookXDP Hook = "xdp"
+	// HookTC attaches the classifier to the clsact ingress hook, for drivers or virtual devices where XDP is
+	// unavailable or buggy
+	HookTC Hook = "tc"
+)
+
+const (
+	// tcFilterHandle and tcFilterPriority identify our filter on the clsact ingress hook, replacing a filter with the
+	// same handle and priority swaps its program atomically
+	tcFilterHandle   = 1
+	tcFilterPriority = 1
+	tcFilterName     = "teleport-challenge"
+)
+
+// ParseHook validates a hook.
+func ParseHook(raw string) (Hook, error) {
+	switch hook := Hook(raw); hook {
+	case HookXDP, HookTC:
+		return hook, nil
+	default:
+		return "", fmt.Errorf("unknown hook %q, expected xdp or tc", raw)
+	}
+}
+
+// tcAttachment is the filter of the classifier on the clsact ingress hook of an interface. Unlike XDP links, TC
+// filters are not tied to a file descriptor: a persistent filter stays attached after the daemon stops.
+type tcAttachment struct {
+	filter     *netlink.BpfFilter
+	persistent bool
+}
+
+func (a *tcAttachment) mode() string {
+	return string(HookTC)
+}
+
+func (a *tcAttachment) detach() error {
+	err := netlink.FilterDel(a.filter)
+	// The filter is gone along with its interface
+	if errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+func (a *tcAttachment) close() error {
+	if a.persistent {
+		return nil
+	}
+	return a.detach()
+}
+
+// attachTC attaches the classifier to the clsact ingress hook of the interface, creating the clsact qdisc if needed.
+// Devices without an ethernet header, like tunnels, get the layer 3 classifier. An existing filter, left by a previous
+// run, is replaced. If persistent is set the filter is kept on close, like pinned XDP links.
+func attachTC(program *ebpf.Program, programL3 *ebpf.Program, iface net.Interface, persistent bool) (*tcAttachment, error) {
+	nlLink, err := netlink.LinkByIndex(iface.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: iface.Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscReplace(qdisc); err != nil {
+		return nil, fmt.Errorf("adding clsact qdisc: %w", err)
+	}
+
+	encapType := nlLink.Attrs().EncapType
+	if encapType != "ether" && encapType != "loopback" {
+		program = programL3
+	}
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: iface.Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    tcFilterHandle,
+			Priority:  tcFilterPriority,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Fd:           program.FD(),
+		Name:         tcFilterName,
+		DirectAction: true,
+	}
+	if err := netlink.FilterReplace(filter); err != nil {
+		return nil, fmt.Errorf("adding TC filter: %w", err)
+	}
+	log.Printf("TC program attached to %s ingress (%s device)", iface.Name, encapType)
+	return &tcAttachment{filter: filter, persistent: persistent}, nil
+}
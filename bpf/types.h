@@ -1,60 +1,375 @@
 #define METRICS_SIZE 65536
+#define SWEEP_SIZE 262144
+#define TCP_FLOWS_SIZE 262144
 #define BLOCKLIST_SIZE 65536
-#define CONNTRACK_SIZE 65536
+#define BAN_REASON_SIZE 64
+// ring buffers size must be a power of 2 multiple of the page size, this holds ~90k connection records
+#define CONNTRACK_RINGBUF_SIZE (1 << 22)
 #define PORT_HISTORY_SIZE 10
+#define ALLOWLIST_SIZE 1024
+#define DENYLIST_SIZE 65536
+#define LOCAL_IPS_SIZE 4096
+#define VLAN_THRESHOLDS_SIZE 4096
+#define NSEC_PER_SEC 1000000000ULL
+
+// Scan techniques, as recorded in ip_metric.scan_types
+#define SCAN_SYN 0x01
+#define SCAN_FIN 0x02
+#define SCAN_NULL 0x04
+#define SCAN_XMAS 0x08
+#define SCAN_ACK 0x10
+#define SCAN_UDP 0x20
+#define IPV6_EXTENSION_HEADERS_MAX 6
+#define VLAN_TAGS_MAX 2
+#define VLAN_VID_MASK 0x0fff
+#define IPV6_FRAGMENT_OFFSET_MASK 0xfff8
 
 #include "headers/common.h"
 #include "headers/bpf_helpers.h"
 
+// ip_address is an IP address in network byte order. IPv4 addresses are stored as IPv4-mapped IPv6 addresses
+// (::ffff:a.b.c.d) so both families share the same maps.
+struct ip_address {
+    __u32 addr[4];
+};
+
+typedef struct ip_address ip_address;
+
+// ipv6_fragment_header is the IPv6 fragment extension header, the kernel only defines it in non-uapi headers.
+struct ipv6_fragment_header {
+    __u8 nexthdr;
+    __u8 reserved;
+    __be16 frag_off;
+    __be32 identification;
+};
+
+typedef struct ipv6_fragment_header ipv6_fragment_header;
+
+// vlan_header is the 802.1Q tag following the ethernet source address, the kernel only defines it in non-uapi headers.
+struct vlan_header {
+    __be16 tci;
+    __be16 encapsulated_proto;
+};
+
+typedef struct vlan_header vlan_header;
+
+// verdict is the decision taken on a packet, translated by each program into its own return codes.
+enum verdict {
+    VERDICT_PASS,
+    VERDICT_DROP,
+};
+
+typedef enum verdict verdict;
+
 // ip_metric represents what we know about an IP:
-// * how much SYN packet have we received
-// * X ports it contacted us recently on
-// Ideally the `ports` field would be a LRU but I took a shortcut did not implement
+// * how much SYN packet have we received since the entry was created
+// * on which VLAN it was last seen, in network byte order (0 if untagged)
+// * the last X ports it contacted us on, and when, in nanoseconds since boot (bpf_ktime_get_ns), so userspace can
+//   count the ports contacted within a sliding window. A new port replaces the least recently seen one.
+// * the techniques it used to probe the ports, a combination of the SCAN_* flags. Besides SYNs, the probes of the
+//   stealth scans (FIN, NULL, Xmas and ACK) are recorded as they never open a connection.
+// * the same history for the UDP ports
+// * the index of the interface it was last seen on
 struct ip_metric {
     __u64 syn_received;
+    __be16 vlan_id;
     __u16 ports[PORT_HISTORY_SIZE];
+    __u8 scan_types;
+    __u64 port_seen[PORT_HISTORY_SIZE];
+    __u16 udp_ports[PORT_HISTORY_SIZE];
+    __u64 udp_port_seen[PORT_HISTORY_SIZE];
+    __u32 ifindex;
 };
 
 typedef struct ip_metric ip_metric;
 
 // ip_metric_map contains the history of which IP address tried to connect to which port.
 // This is a least-recently-used hashmap, keys are the IP addresses and values are ip_metric.
-// This map is filled by a XDP program when a SYN packet is received and flushed by the go program in userspace.
+// This map is filled by a XDP program when a SYN packet is received. The go program in userspace removes the IPs it
+// bans and the IPs that stayed quiet for a whole detection window.
 struct bpf_map_def SEC("maps") ip_metric_map =
 {
     // per-cpu maps avoid cross-cpu locks, which is especially important as we're in the critical path
     .type = BPF_MAP_TYPE_LRU_PERCPU_HASH,
+    .key_size = sizeof(ip_address),
+    .value_size = sizeof(ip_metric),
+    .max_entries = METRICS_SIZE
+};
+
+// ip_metric_scratch_map holds a single ip_metric per CPU, used to build the new entries of ip_metric_map. An ip_metric
+// is too large to be built on the stack, which is limited to 512 bytes.
+struct bpf_map_def SEC("maps") ip_metric_scratch_map =
+{
+    .type = BPF_MAP_TYPE_PERCPU_ARRAY,
     .key_size = sizeof(__u32),
     .value_size = sizeof(ip_metric),
+    .max_entries = 1
+};
+
+// port_history is the ports an IP contacted and when, in nanoseconds since boot, like the port history of ip_metric.
+struct port_history {
+    __u16 ports[PORT_HISTORY_SIZE];
+    __u64 port_seen[PORT_HISTORY_SIZE];
+};
+
+typedef struct port_history port_history;
+
+// port_scan_map contains the port history of the IPs sending SYNs, for the in-kernel blocking only. Unlike
+// ip_metric_map it is shared between CPUs, so the scans spread across CPUs by RSS are blocked as soon as they cross
+// the threshold. Concurrent SYNs of an IP may overwrite each other's port, which delays the block by a SYN at worst.
+// It is only filled when the in-kernel blocking is enabled, and the entry of an IP is removed when the program blocks
+// it, so an unblocked IP starts over.
+struct bpf_map_def SEC("maps") port_scan_map =
+{
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(ip_address),
+    .value_size = sizeof(port_history),
     .max_entries = METRICS_SIZE
 };
 
+// sweep_key is a source IP and one of the destination IPs it probed.
+struct sweep_key {
+    ip_address source_ip;
+    ip_address dest_ip;
+};
+
+typedef struct sweep_key sweep_key;
+
+// sweep_map records when each source IP last probed each destination IP, in nanoseconds since boot, to detect
+// horizontal scans: the same ports probed on many hosts, as seen when the program is attached on a router. Unlike the
+// ports, the destinations are not kept in ip_metric so the sweep threshold is not bounded by a history size.
+// A probe only refreshes a timestamp, the map is shared between CPUs. It is only filled when sweep detection is enabled
+// (see config). The go program in userspace removes the entries older than the detection window and the entries of the
+// IPs it bans.
+struct bpf_map_def SEC("maps") sweep_map =
+{
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(sweep_key),
+    .value_size = sizeof(__u64),
+    .max_entries = SWEEP_SIZE
+};
+
+// tcp_flow is the source IP and port and the destination IP and port of the TCP packets of a connection.
+struct tcp_flow {
+    ip_address source_ip;
+    ip_address dest_ip;
+    __u16 source_port;
+    __u16 dest_port;
+};
+
+typedef struct tcp_flow tcp_flow;
+
+// tcp_flow_map contains the TCP connections seen by the XDP program, so the ACKs of a connection are not taken for ACK
+// scan probes. Only the incoming direction of a connection is seen: a flow is recorded on the SYN of an incoming
+// connection, on the SYN-ACK of an outgoing one, and on the first packet carrying data of a connection opened before
+// the program was attached. Values are unused, flows are only evicted when the map is full.
+struct bpf_map_def SEC("maps") tcp_flow_map =
+{
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(tcp_flow),
+    .value_size = sizeof(__u8),
+    .max_entries = TCP_FLOWS_SIZE
+};
+
 // ip_blocked_map contains the blocked IPs. Keys are the IP, values are the epoch timestamp when the IP was blocked.
-// This map is read by the XDP firewall program and filled by the go program in userspace when a scan is detected.
+// This map is read by the XDP firewall program and filled by the go program in userspace when a scan is detected, or
+// by the XDP program itself when an IP crosses the threshold (see config).
 struct bpf_map_def SEC("maps") ip_blocked_map =
 {
     .type = BPF_MAP_TYPE_LRU_HASH,
-    .key_size = sizeof(__u32),
+    .key_size = sizeof(ip_address),
     .value_size = sizeof(__u64),
     .max_entries = BLOCKLIST_SIZE
 };
 
-// tcp_connection is a struct representing the log record of a connection
-struct tcp_connection {
-    __u32 source_ip;
-    __u32 dest_ip;
+// ban_info is the duration of a ban, in nanoseconds and 0 if permanent, and its reason, NUL-terminated unless it fills
+// the array.
+struct ban_info {
+    __u64 duration;
+    char reason[BAN_REASON_SIZE];
+};
+
+typedef struct ban_info ban_info;
+
+// ban_info_map contains the duration and reason of the bans of ip_blocked_map. It is only used by the go program in
+// userspace, and pinned along with ip_blocked_map so the bans keep them across restarts.
+struct bpf_map_def SEC("maps") ban_info_map =
+{
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(ip_address),
+    .value_size = sizeof(ban_info),
+    .max_entries = BLOCKLIST_SIZE
+};
+
+// local_ip_map contains the addresses of the host, values are unused. This map is filled by the go program from the
+// addresses of all the interfaces, so only the datagrams addressed to the host are recorded as UDP flows: a router
+// forwards the datagrams of the flows of other hosts, and we cannot tell their replies apart without connection
+// tracking.
+struct bpf_map_def SEC("maps") local_ip_map =
+{
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(ip_address),
+    .value_size = sizeof(__u8),
+    .max_entries = LOCAL_IPS_SIZE
+};
+
+// lpm_key is the key of longest-prefix-match maps: a prefix length followed by the IP address.
+// As IPv4 addresses are IPv4-mapped, the prefix length of an IPv4 prefix is offset by 96 bits.
+struct lpm_key {
+    __u32 prefixlen;
+    ip_address ip;
+};
+
+typedef struct lpm_key lpm_key;
+
+// ip_allowed_map contains the allowlisted prefixes. Keys are lpm_key, values are unused.
+// This map is filled by the go program at startup and read by the XDP firewall program: allowlisted IPs are never
+// dropped, even if they are in ip_blocked_map.
+struct bpf_map_def SEC("maps") ip_allowed_map =
+{
+    .type = BPF_MAP_TYPE_LPM_TRIE,
+    .key_size = sizeof(lpm_key),
+    .value_size = sizeof(__u8),
+    .max_entries = ALLOWLIST_SIZE,
+    // LPM tries cannot be preallocated
+    .map_flags = BPF_F_NO_PREALLOC
+};
+
+// ip_denied_map contains the denied prefixes. Keys are lpm_key, values are unused.
+// This map is filled by the go program from the denylist file and read by the XDP firewall program: traffic coming
+// from denied prefixes is dropped unless the IP is allowlisted.
+struct bpf_map_def SEC("maps") ip_denied_map =
+{
+    .type = BPF_MAP_TYPE_LPM_TRIE,
+    .key_size = sizeof(lpm_key),
+    .value_size = sizeof(__u8),
+    .max_entries = DENYLIST_SIZE,
+    .map_flags = BPF_F_NO_PREALLOC
+};
+
+// connection_record is the log record of a TCP connection attempt or of the first datagram of a UDP flow. The maps
+// streaming it kept their tcp_connection_* names, as tcp_connection_ringbuf is pinned.
+struct connection_record {
+    ip_address source_ip;
+    ip_address dest_ip;
     __u16 source_port;
     __u16 dest_port;
+    // VLAN ID in network byte order, the innermost one for QinQ frames and 0 if untagged
+    __be16 vlan_id;
+    // set when this SYN made the program block the source IP, so userspace can log the ban and apply its policy
+    __u8 blocked;
+    // IPPROTO_TCP, or IPPROTO_UDP for the first datagram of a UDP flow
+    __u8 protocol;
+    // index of the interface the connection was received on
+    __u32 ifindex;
+};
+
+typedef struct connection_record connection_record;
+
+// use_ringbuf tells if the connection records are streamed through tcp_connection_ringbuf (Linux 5.8+) or through
+// tcp_connection_perf_array on older kernels. This constant is rewritten by the loader depending on the kernel features.
+volatile const __u8 use_ringbuf = 1;
+
+// tcp_connection_ringbuf is a ring buffer streaming individual TCP connection attempts and UDP flows to userspace.
+// It is populated by the XDP program and consumed by userspace as soon as records are available.
+struct bpf_map_def SEC("maps") tcp_connection_ringbuf =
+{
+    .type = BPF_MAP_TYPE_RINGBUF,
+    .max_entries = CONNTRACK_RINGBUF_SIZE
+};
+
+// tcp_connection_perf_array is the fallback of tcp_connection_ringbuf for kernels not supporting ring buffers.
+// The go program sets max_entries to the number of CPUs.
+struct bpf_map_def SEC("maps") tcp_connection_perf_array =
+{
+    .type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u32),
+    .max_entries = 0
+};
+
+// tcp_connection_lost_map counts the connection records the XDP program could not send because userspace did not
+// consume them fast enough. It has a single entry.
+struct bpf_map_def SEC("maps") tcp_connection_lost_map =
+{
+    // per-cpu maps avoid cross-cpu locks, which is especially important as we're in the critical path
+    .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .max_entries = 1
 };
 
-typedef struct tcp_connection tcp_connection;
+// config holds the parameters of the in-kernel port scan detection, written by the go program in userspace.
+struct config {
+    // length of the sliding window, in nanoseconds
+    __u64 window;
+    // epoch time of the boot in nanoseconds, so block times can be computed from bpf_ktime_get_ns
+    __u64 boot_time;
+    // IPs connecting to more ports than threshold within the window are blocked
+    __u32 threshold;
+    // in-kernel blocking is disabled until userspace writes the config, and in dry run mode
+    __u8 enabled;
+    // UDP flows are only recorded when UDP scan detection is enabled
+    __u8 udp_enabled;
+    // the destinations of the probes are only recorded in sweep_map when sweep detection is enabled
+    __u8 sweep_enabled;
+    // SYNs per second each source IP is allowed to send, the excess is dropped. 0 disables the rate limiting
+    __u32 syn_rate;
+    // SYNs a source IP can send at once before being rate limited
+    __u32 syn_burst;
+    // local port range of the outgoing connections, ACKs and datagrams to these ports are replies rather than ACK scan
+    // probes or new UDP flows
+    __u16 ephemeral_port_min;
+    __u16 ephemeral_port_max;
+};
+
+typedef struct config config;
 
-// tcp_connection_tracking_map is a queue keeping track of individual TCP connection attempts
-// It is populated by the XDP program and consumed by userspace.
-struct bpf_map_def SEC("maps") tcp_connection_tracking_map =
+// config_map contains the config, it has a single entry.
+struct bpf_map_def SEC("maps") config_map =
 {
-    .type = BPF_MAP_TYPE_QUEUE,
-    .key_size = 0,
-    .value_size = sizeof(tcp_connection),
-    .max_entries = CONNTRACK_SIZE
-};
\ No newline at end of file
+    .type = BPF_MAP_TYPE_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(config),
+    .max_entries = 1
+};
+
+// vlan_threshold_map overrides config.threshold for IPs seen on specific VLANs. Keys are VLAN IDs in network byte
+// order, values are thresholds. It is filled by the go program in userspace.
+struct bpf_map_def SEC("maps") vlan_threshold_map =
+{
+    .type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(__be16),
+    .value_size = sizeof(__u32),
+    .max_entries = VLAN_THRESHOLDS_SIZE
+};
+
+// syn_bucket is the token bucket rate limiting the SYNs of an IP. Tokens are counted in billionths of SYN so the
+// bucket can be refilled at every packet using the time elapsed in nanoseconds.
+struct syn_bucket {
+    __u64 tokens;
+    // bpf_ktime_get_ns of the last refill
+    __u64 last;
+};
+
+typedef struct syn_bucket syn_bucket;
+
+// syn_bucket_map contains the token bucket of each IP sending SYNs when rate limiting is enabled. Unlike
+// ip_metric_map it is shared between CPUs, so concurrent SYNs of an IP may let a few extra SYNs through.
+struct bpf_map_def SEC("maps") syn_bucket_map =
+{
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .key_size = sizeof(ip_address),
+    .value_size = sizeof(syn_bucket),
+    .max_entries = METRICS_SIZE
+};
+
+// syn_dropped_map counts the SYNs dropped by the rate limiting. It has a single entry.
+struct bpf_map_def SEC("maps") syn_dropped_map =
+{
+    // per-cpu maps avoid cross-cpu locks, which is especially important as we're in the critical path
+    .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .max_entries = 1
+};
@@ -4,128 +4,618 @@
 #include <linux/bpf.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/ipv6.h>
+#include <linux/pkt_cls.h>
 #include <linux/tcp.h>
+#include <linux/udp.h>
 
 #include "headers/common.h"
 #include "headers/bpf_helpers.h"
 
 #include "types.h"
 
-int port_is_in_ip_metric(ip_metric *metric, u16 port) {
+// bpf_perf_event_output, used when ring buffers are not supported, is only available to GPL-compatible programs
+char __license[] SEC("license") = "Dual MIT/GPL";
+
+// Record that a port was contacted at the given time in a port history. A port missing from the history replaces the
+// least recently seen one, empty slots were never seen and are used first. Returns 1 if the port was missing.
+static __always_inline int record_port(u16 *ports, u64 *port_seen, u16 port, u64 now) {
     int i;
+    int oldest = 0;
     // eBPF VM doesn't support loops, this asks the compiler to replace the "for" by all its individual iterations
     #pragma clang loop unroll(full)
     for (i = 0; i < PORT_HISTORY_SIZE ; ++i) {
-        if (metric->ports[i] == port) {
-            return 1;
+        if (ports[i] == port && port_seen[i]) {
+            port_seen[i] = now;
+            return 0;
+        }
+        if (port_seen[i] < port_seen[oldest]) {
+            oldest = i;
+        }
+    }
+    ports[oldest] = port;
+    port_seen[oldest] = now;
+    return 1;
+}
+
+// Return the zeroed scratch ip_metric of the CPU, see ip_metric_scratch_map, or NULL if the lookup failed.
+static __always_inline ip_metric *new_ip_metric(void) {
+    u32 scratch_key = 0;
+    ip_metric *metric = bpf_map_lookup_elem(&ip_metric_scratch_map, &scratch_key);
+    if (metric) {
+        __builtin_memset(metric, 0, sizeof(ip_metric));
+    }
+    return metric;
+}
+
+// Record that a source IP probed a destination IP at the given time, see sweep_map.
+static __always_inline void record_dest(ip_address *source_ip, ip_address *dest_ip, u64 now) {
+    u32 config_key = 0;
+    config *cfg = bpf_map_lookup_elem(&config_map, &config_key);
+    if (!cfg || !cfg->sweep_enabled) {
+        return;
+    }
+
+    sweep_key key = {};
+    key.source_ip = *source_ip;
+    key.dest_ip = *dest_ip;
+    bpf_map_update_elem(&sweep_map, &key, &now, BPF_ANY);
+}
+
+// Tell if a port, in network byte order, belongs to the local port range: packets to these ports are replies to our
+// outgoing connections and flows, not probes.
+static __always_inline int is_ephemeral_port(u16 port) {
+    u32 config_key = 0;
+    config *cfg = bpf_map_lookup_elem(&config_map, &config_key);
+    u16 host_port = ntohs(port);
+    // Without config every port is considered ephemeral, so nothing is taken for a probe
+    return !cfg || (host_port >= cfg->ephemeral_port_min && host_port <= cfg->ephemeral_port_max);
+}
+
+// Record a TCP flow in tcp_flow_map, unless it is already there.
+static __always_inline void record_flow(tcp_flow *flow) {
+    if (bpf_map_lookup_elem(&tcp_flow_map, flow)) {
+        return;
+    }
+    u8 seen = 1;
+    bpf_map_update_elem(&tcp_flow_map, flow, &seen, BPF_ANY);
+}
+
+// Classify a TCP packet into the scan technique it could be a probe of, or 0 if it is part of a connection. Only the
+// first packet of the three-way handshake is a SYN probe. FIN, NULL and Xmas probes carry flag combinations no
+// connection uses. ACK probes are pure ACKs without payload outside of any connection tracked in tcp_flow_map. The
+// connections opened before the program was attached are only tracked once they carry data: until then, ACKs to the
+// ephemeral ports are assumed to be replies to our outgoing connections, and ACKs to the ports of the local services
+// are only recorded, like their SYNs were.
+static __always_inline u8 classify_probe(struct tcphdr *tcp_header, u32 tcp_length, tcp_flow *flow) {
+    if (tcp_header->syn) {
+        // The SYN of an incoming connection or the SYN-ACK of an outgoing one
+        record_flow(flow);
+        return tcp_header->ack ? 0 : SCAN_SYN;
+    }
+    if (tcp_header->rst) {
+        return 0;
+    }
+    if (!tcp_header->ack) {
+        if (tcp_header->fin && tcp_header->psh && tcp_header->urg) {
+            return SCAN_XMAS;
+        }
+        if (tcp_header->fin && !tcp_header->psh && !tcp_header->urg) {
+            return SCAN_FIN;
+        }
+        if (!tcp_header->fin && !tcp_header->psh && !tcp_header->urg) {
+            return SCAN_NULL;
         }
+        return 0;
+    }
+    if (tcp_header->fin || tcp_header->psh || tcp_header->urg || tcp_length > tcp_header->doff * 4) {
+        record_flow(flow);
+        return 0;
+    }
+    if (bpf_map_lookup_elem(&tcp_flow_map, flow) || is_ephemeral_port(tcp_header->dest)) {
+        return 0;
     }
-    return 0;
+    return SCAN_ACK;
 }
-// Insert a port into the ip_metric.ports ring buffer
-void add_port_to_ip_metric(ip_metric *metric, u16 port) {
+
+// Count the ports of a port history contacted since the given time, in nanoseconds since boot.
+static __always_inline u32 count_ports_since(u64 *port_seen, u64 since) {
+    u32 count = 0;
     int i;
     // eBPF VM doesn't support loops, this asks the compiler to replace the "for" by all its individual iterations
     #pragma clang loop unroll(full)
-    for (i = PORT_HISTORY_SIZE; i > 0 ; --i) {
-       metric->ports[i] = metric->ports[i-1];
+    for (i = 0; i < PORT_HISTORY_SIZE ; ++i) {
+        if (port_seen[i] && port_seen[i] >= since) {
+            count++;
+        }
     }
-    metric->ports[0] = port;
+    return count;
 }
 
-SEC("xdp_metrics")
-int xdp_prog_main(struct xdp_md *ctx) {
+// Record the port in the shared port history of the IP, see port_scan_map, and block the IP if it contacted more
+// ports than the threshold within the window. Returns 1 if the IP was blocked by this call.
+static __always_inline int block_port_scan(ip_address *source_ip, u16 dest_port, u16 vlan_id, u64 now) {
+    u32 config_key = 0;
+    config *cfg = bpf_map_lookup_elem(&config_map, &config_key);
+    if (!cfg || !cfg->enabled) {
+        return 0;
+    }
 
-    // Initialize data.
-    void *data_end = (void *)(long)ctx->data_end;
-    void *data = (void *)(long)ctx->data;
+    port_history *history = bpf_map_lookup_elem(&port_scan_map, source_ip);
+    port_history initval = {};
+    if (history) {
+        record_port(history->ports, history->port_seen, dest_port, now);
+    }
+    else {
+        initval.ports[0] = dest_port;
+        initval.port_seen[0] = now;
+        bpf_map_update_elem(&port_scan_map, source_ip, &initval, BPF_ANY);
+        history = &initval;
+    }
 
-    // Scan ethernet header.
+    u32 threshold = cfg->threshold;
+    if (vlan_id) {
+        u32 *vlan_threshold = bpf_map_lookup_elem(&vlan_threshold_map, &vlan_id);
+        if (vlan_threshold) {
+            threshold = *vlan_threshold;
+        }
+    }
+
+    u64 since = now > cfg->window ? now - cfg->window : 0;
+    if (count_ports_since(history->port_seen, since) <= threshold) {
+        return 0;
+    }
+
+    // Several CPUs might cross the threshold at the same time, only the first one reports the ban
+    u64 block_time = (cfg->boot_time + now) / NSEC_PER_SEC;
+    if (bpf_map_update_elem(&ip_blocked_map, source_ip, &block_time, BPF_NOEXIST)) {
+        return 0;
+    }
+    bpf_map_delete_elem(&port_scan_map, source_ip);
+    return 1;
+}
+
+// Take a token from the SYN bucket of the IP. Returns 0 if the bucket is empty and the SYN must be dropped.
+static __always_inline int take_syn_token(ip_address *source_ip, u64 now) {
+    u32 config_key = 0;
+    config *cfg = bpf_map_lookup_elem(&config_map, &config_key);
+    if (!cfg || !cfg->syn_rate) {
+        return 1;
+    }
+
+    u64 capacity = (u64)cfg->syn_burst * NSEC_PER_SEC;
+    syn_bucket *bucket = bpf_map_lookup_elem(&syn_bucket_map, source_ip);
+    if (!bucket) {
+        syn_bucket initval = {};
+        initval.tokens = capacity > NSEC_PER_SEC ? capacity - NSEC_PER_SEC : 0;
+        initval.last = now;
+        bpf_map_update_elem(&syn_bucket_map, source_ip, &initval, BPF_ANY);
+        return 1;
+    }
+
+    // Refill the bucket with the tokens earned since the last SYN, without overflowing when the IP was quiet for long
+    u64 elapsed = now > bucket->last ? now - bucket->last : 0;
+    u64 tokens = capacity;
+    if (elapsed < capacity / cfg->syn_rate) {
+        tokens = bucket->tokens + elapsed * cfg->syn_rate;
+        if (tokens > capacity) {
+            tokens = capacity;
+        }
+    }
+    bucket->last = now;
+
+    if (tokens < NSEC_PER_SEC) {
+        bucket->tokens = tokens;
+        u32 dropped_key = 0;
+        u64 *dropped = bpf_map_lookup_elem(&syn_dropped_map, &dropped_key);
+        if (dropped) {
+            *dropped += 1;
+        }
+        return 0;
+    }
+    bucket->tokens = tokens - NSEC_PER_SEC;
+    return 1;
+}
+
+// Parse the IPv6 extension headers until the TCP or UDP header.
+// Returns a pointer to the TCP or UDP header, or NULL if the packet carries neither (or carries a non-first fragment).
+// Sets *protocol to the protocol of the returned header, and *truncated if the packet ends in the middle of a header.
+static __always_inline void *skip_ipv6_extension_headers(void *cursor, void *data_end, u8 next_header, u8 *protocol, int *truncated) {
+    int i;
+    // eBPF VM doesn't support loops, this asks the compiler to replace the "for" by all its individual iterations
+    #pragma clang loop unroll(full)
+    for (i = 0; i < IPV6_EXTENSION_HEADERS_MAX; ++i) {
+        struct ipv6_opt_hdr *extension_header = cursor;
+        ipv6_fragment_header *fragment_header = cursor;
+
+        switch (next_header) {
+        case IPPROTO_TCP:
+        case IPPROTO_UDP:
+            *protocol = next_header;
+            return cursor;
+        case IPPROTO_HOPOPTS:
+        case IPPROTO_ROUTING:
+        case IPPROTO_DSTOPTS:
+            if (extension_header + 1 > (struct ipv6_opt_hdr *)data_end) {
+                *truncated = 1;
+                return NULL;
+            }
+            next_header = extension_header->nexthdr;
+            // hdrlen is expressed in 8-octet units, not including the first 8 octets
+            cursor += (extension_header->hdrlen + 1) * 8;
+            break;
+        case IPPROTO_AH:
+            if (extension_header + 1 > (struct ipv6_opt_hdr *)data_end) {
+                *truncated = 1;
+                return NULL;
+            }
+            next_header = extension_header->nexthdr;
+            // hdrlen is expressed in 4-octet units, not including the first 8 octets
+            cursor += (extension_header->hdrlen + 2) * 4;
+            break;
+        case IPPROTO_FRAGMENT:
+            if (fragment_header + 1 > (ipv6_fragment_header *)data_end) {
+                *truncated = 1;
+                return NULL;
+            }
+            // Only the first fragment contains the TCP or UDP header
+            if (fragment_header->frag_off & htons(IPV6_FRAGMENT_OFFSET_MASK)) {
+                return NULL;
+            }
+            next_header = fragment_header->nexthdr;
+            cursor += sizeof(ipv6_fragment_header);
+            break;
+        default:
+            return NULL;
+        }
+    }
+    // Too many extension headers, we give up
+    return NULL;
+}
+
+// Skip the ethernet header and the 802.1Q/802.1ad tags, QinQ frames carry two of them.
+// Returns a pointer to the network header, or NULL if the packet ends in the middle of a header.
+// Sets *protocol to the network protocol and *vlan_id to the innermost VLAN ID, in network byte order.
+static __always_inline void *skip_ethernet_header(void *data, void *data_end, u16 *protocol, u16 *vlan_id) {
     struct ethhdr *ethernet_header = data;
 
     // We have to make sure we won't try to read memory out of the packet
     // Without this check the BPF validator is angry
     if (ethernet_header + 1 > (struct ethhdr *)data_end) {
-        return XDP_DROP;
+        return NULL;
+    }
+
+    void *network_header = ethernet_header + 1;
+    *protocol = ethernet_header->h_proto;
+    int i;
+    // eBPF VM doesn't support loops, this asks the compiler to replace the "for" by all its individual iterations
+    #pragma clang loop unroll(full)
+    for (i = 0; i < VLAN_TAGS_MAX; ++i) {
+        if (*protocol != htons(ETH_P_8021Q) && *protocol != htons(ETH_P_8021AD)) {
+            break;
+        }
+        vlan_header *vlan = network_header;
+        if (vlan + 1 > (vlan_header *)data_end) {
+            return NULL;
+        }
+        // We keep the innermost VLAN ID
+        *vlan_id = vlan->tci & htons(VLAN_VID_MASK);
+        *protocol = vlan->encapsulated_proto;
+        network_header = vlan + 1;
+    }
+    return network_header;
+}
+
+// Stream a connection record to userspace. ctx is the context of the program, needed by the perf event array.
+static __always_inline void output_connection(void *ctx, connection_record *connection) {
+    long err;
+    if (use_ringbuf) {
+        err = bpf_ringbuf_output(&tcp_connection_ringbuf, connection, sizeof(*connection), 0);
+    }
+    else {
+        err = bpf_perf_event_output(ctx, &tcp_connection_perf_array, BPF_F_CURRENT_CPU, connection, sizeof(*connection));
+    }
+    // The buffer is full, we keep track of the lost record
+    if (err) {
+        u32 lost_key = 0;
+        u64 *lost = bpf_map_lookup_elem(&tcp_connection_lost_map, &lost_key);
+        if (lost) {
+            *lost += 1;
+        }
     }
+}
 
-    // Bail out if protocol is not IP
-    if (ethernet_header->h_proto != htons(ETH_P_IP)) {
-        return XDP_PASS;
+// Record the port a UDP datagram is sent to. Without connection tracking, the first datagram to a port missing from
+// the UDP port history of the IP is considered a new flow and streamed to userspace. Only the datagrams addressed to
+// the host are recorded, except the ones to the local port range: they are replies to our own queries (DNS, NTP...).
+static __always_inline verdict process_udp_datagram(void *ctx, struct udphdr *udp_header, void *data_end, ip_address *source_ip, ip_address *dest_ip, u16 vlan_id, u32 ifindex) {
+    if (udp_header + 1 > (struct udphdr *)data_end) {
+        return VERDICT_DROP;
     }
 
-    // Scan IP header
-    struct iphdr *ip_header = NULL;
+    u32 config_key = 0;
+    config *cfg = bpf_map_lookup_elem(&config_map, &config_key);
+    if (!cfg || !cfg->udp_enabled) {
+        return VERDICT_PASS;
+    }
+    u16 dest_port = udp_header->dest;
+    u16 host_port = ntohs(dest_port);
+    if (host_port >= cfg->ephemeral_port_min && host_port <= cfg->ephemeral_port_max) {
+        return VERDICT_PASS;
+    }
+    if (!bpf_map_lookup_elem(&local_ip_map, dest_ip)) {
+        return VERDICT_PASS;
+    }
 
-    ip_header = (data + sizeof(struct ethhdr));
+    ip_metric *metric = NULL;
+    metric = bpf_map_lookup_elem(&ip_metric_map, source_ip);
+    u64 now = bpf_ktime_get_ns();
+    int new_flow = 1;
 
-    // Same than for the ethernet header, we have to make sure we won't attempt to read memory out of the packet
-    if (ip_header + 1 > (struct iphdr *)data_end) {
-        return XDP_DROP;
+    if (metric) {
+        metric->vlan_id = vlan_id;
+        metric->ifindex = ifindex;
+        metric->scan_types |= SCAN_UDP;
+        new_flow = record_port(metric->udp_ports, metric->udp_port_seen, dest_port, now);
+        bpf_map_update_elem(&ip_metric_map, source_ip, metric, BPF_ANY);
+    }
+    else {
+        ip_metric *initval = new_ip_metric();
+        if (initval) {
+            initval->vlan_id = vlan_id;
+            initval->ifindex = ifindex;
+            initval->scan_types = SCAN_UDP;
+            initval->udp_ports[0] = dest_port;
+            initval->udp_port_seen[0] = now;
+            bpf_map_update_elem(&ip_metric_map, source_ip, initval, BPF_ANY);
+        }
+    }
+    record_dest(source_ip, dest_ip, now);
+
+    if (new_flow) {
+        connection_record connection = {};
+        connection.source_ip = *source_ip;
+        connection.dest_ip = *dest_ip;
+        connection.source_port = udp_header->source;
+        connection.dest_port = dest_port;
+        connection.vlan_id = vlan_id;
+        connection.protocol = IPPROTO_UDP;
+        connection.ifindex = ifindex;
+        output_connection(ctx, &connection);
+    }
+    return VERDICT_PASS;
+}
+
+// Logs, counts and filters a packet starting at its network header. This is shared by the XDP and TC programs, ctx is
+// the context of the program, needed to output records to the perf event array.
+static __always_inline verdict process_packet(void *ctx, void *network_header, void *data_end, u16 protocol, u16 vlan_id, u32 ifindex) {
+    // IPv4 addresses are stored as IPv4-mapped IPv6 addresses so both families share the same maps
+    ip_address source_ip = {};
+    ip_address dest_ip = {};
+    void *l4_header = NULL;
+    u8 l4_protocol = 0;
+    // length of the TCP or UDP header and payload, the packet can be longer because of the ethernet padding
+    u32 l4_length = 0;
+
+    if (protocol == htons(ETH_P_IP)) {
+        // Scan IP header
+        struct iphdr *ip_header = NULL;
+
+        ip_header = network_header;
+
+        // Same than for the ethernet header, we have to make sure we won't attempt to read memory out of the packet
+        if (ip_header + 1 > (struct iphdr *)data_end) {
+            return VERDICT_DROP;
+        }
+
+        // Bail out if protocol is neither TCP nor UDP
+        if (ip_header->protocol != IPPROTO_TCP && ip_header->protocol != IPPROTO_UDP) {
+            return VERDICT_PASS;
+        }
+
+        source_ip.addr[2] = htonl(0xffff);
+        source_ip.addr[3] = ip_header->saddr;
+        dest_ip.addr[2] = htonl(0xffff);
+        dest_ip.addr[3] = ip_header->daddr;
+
+        l4_protocol = ip_header->protocol;
+        l4_header = (network_header + (ip_header->ihl * 4));
+        l4_length = ntohs(ip_header->tot_len) - ip_header->ihl * 4;
+    }
+    else if (protocol == htons(ETH_P_IPV6)) {
+        // Scan IPv6 header
+        struct ipv6hdr *ipv6_header = NULL;
+
+        ipv6_header = network_header;
+
+        if (ipv6_header + 1 > (struct ipv6hdr *)data_end) {
+            return VERDICT_DROP;
+        }
+
+        __builtin_memcpy(&source_ip, &ipv6_header->saddr, sizeof(ip_address));
+        __builtin_memcpy(&dest_ip, &ipv6_header->daddr, sizeof(ip_address));
+
+        // The TCP or UDP header might be behind extension headers
+        int truncated = 0;
+        l4_header = skip_ipv6_extension_headers(ipv6_header + 1, data_end, ipv6_header->nexthdr, &l4_protocol, &truncated);
+        if (truncated) {
+            return VERDICT_DROP;
+        }
+        // Bail out if protocol is neither TCP nor UDP
+        if (!l4_header) {
+            return VERDICT_PASS;
+        }
+        l4_length = ntohs(ipv6_header->payload_len) - (l4_header - (void *)(ipv6_header + 1));
     }
+    else {
+        // Bail out if protocol is not IP
+        return VERDICT_PASS;
+    }
+
+    // Allowlisted IPs skip the denylist and blocklist entirely
+    lpm_key source_key = {};
+    source_key.prefixlen = 128;
+    source_key.ip = source_ip;
+    int allowed = bpf_map_lookup_elem(&ip_allowed_map, &source_key) != NULL;
+    if (!allowed) {
+        // Drop the packet if the IP belongs to a denied prefix
+        if (bpf_map_lookup_elem(&ip_denied_map, &source_key)) {
+            return VERDICT_DROP;
+        }
 
-    // Bail out if protocol is not TCP
-    if (ip_header->protocol != IPPROTO_TCP) {
-        return XDP_PASS;
+        // Drop the packet is the IP is blocked
+        u64 *blocked_time;
+        blocked_time = bpf_map_lookup_elem(&ip_blocked_map, &source_ip);
+        if (blocked_time) {
+            return VERDICT_DROP;
+        }
     }
 
-    // Scan TCP header.
-    struct tcphdr *tcp_header = NULL;
-    tcp_header = (data + sizeof(struct ethhdr) + (ip_header->ihl * 4));
+    if (l4_protocol == IPPROTO_UDP) {
+        return process_udp_datagram(ctx, l4_header, data_end, &source_ip, &dest_ip, vlan_id, ifindex);
+    }
 
+    struct tcphdr *tcp_header = l4_header;
     // Same situation than for ethernet and ip headers
     if (tcp_header + 1 > (struct tcphdr *)data_end) {
-        return XDP_DROP;
+        return VERDICT_DROP;
     }
 
-    // We retrieve source and dest IP/port
-    u32 source_ip = ip_header->saddr;
-    u32 dest_ip = ip_header->daddr;
+    // We retrieve source and dest port
     u16 source_port = tcp_header->source;
     u16 dest_port = tcp_header->dest;
 
-    // Drop the packet is the IP is blocked
-    u64 *blocked_time;
-    blocked_time = bpf_map_lookup_elem(&ip_blocked_map, &source_ip);
-    if (blocked_time) {
-        return XDP_DROP;
-    }
-
-    // We want to catch only the first packet of the three-way handshake: SYN, SYN+ACK, ACK.
-    if (!tcp_header->syn || tcp_header->ack){
-        return XDP_PASS;
+    // We want to catch only the probes of port scans, see classify_probe.
+    tcp_flow flow = {};
+    flow.source_ip = source_ip;
+    flow.dest_ip = dest_ip;
+    flow.source_port = source_port;
+    flow.dest_port = dest_port;
+    u8 scan_type = classify_probe(tcp_header, l4_length, &flow);
+    if (!scan_type) {
+        return VERDICT_PASS;
     }
 
     ip_metric *metric = NULL;
     metric = bpf_map_lookup_elem(&ip_metric_map, &source_ip);
+    u64 now = bpf_ktime_get_ns();
 
-    // If a map elem already exist for this IP we increment and eventually add port.
+    // If a map elem already exist for this IP we increment and record the port.
     // Else we have to initialize a new ip_metric
     if (metric) {
-        metric->syn_received += 1;
-        // We check if the port was already seen
-        // If this is a new port we register it
-        // Please note that ip_metric.ports is not exactly a LRU buffer: if a port was already seen it won't be moved
-        // back to the first position
-        if (! port_is_in_ip_metric(metric, dest_port)) {
-            add_port_to_ip_metric(metric, dest_port);
+        if (scan_type == SCAN_SYN) {
+            metric->syn_received += 1;
         }
-        bpf_map_update_elem(&ip_metric_map, &ip_header->saddr, metric, BPF_ANY);
+        metric->vlan_id = vlan_id;
+        metric->ifindex = ifindex;
+        metric->scan_types |= scan_type;
+        record_port(metric->ports, metric->port_seen, dest_port, now);
+        bpf_map_update_elem(&ip_metric_map, &source_ip, metric, BPF_ANY);
     }
     else {
-        ip_metric initval = {};
-        initval.syn_received = 1;
-        initval.ports[0] = dest_port;
-        bpf_map_update_elem(&ip_metric_map, &ip_header->saddr, &initval, BPF_ANY);
+        ip_metric *initval = new_ip_metric();
+        if (initval) {
+            initval->syn_received = scan_type == SCAN_SYN;
+            initval->vlan_id = vlan_id;
+            initval->ifindex = ifindex;
+            initval->scan_types = scan_type;
+            initval->ports[0] = dest_port;
+            initval->port_seen[0] = now;
+            bpf_map_update_elem(&ip_metric_map, &source_ip, initval, BPF_ANY);
+        }
+    }
+    record_dest(&source_ip, &dest_ip, now);
+
+    // Stealth probes are not connections, they are neither streamed nor rate limited. They don't trigger the in-kernel
+    // blocking either as it is notified through the connection records, the blocking watcher catches them.
+    if (scan_type != SCAN_SYN) {
+        return VERDICT_PASS;
     }
 
-    tcp_connection connection = {};
+    // Allowlisted IPs are never blocked nor rate limited
+    int blocked = 0;
+    if (!allowed) {
+        blocked = block_port_scan(&source_ip, dest_port, vlan_id, now);
+        // The SYNs over the rate are dropped without being streamed to userspace, a flood would fill the ring buffer
+        if (!blocked && !take_syn_token(&source_ip, now)) {
+            return VERDICT_DROP;
+        }
+    }
+
+    connection_record connection = {};
     connection.source_ip = source_ip;
     connection.dest_ip = dest_ip;
     connection.source_port = source_port;
     connection.dest_port = dest_port;
+    connection.vlan_id = vlan_id;
+    connection.blocked = blocked;
+    connection.protocol = IPPROTO_TCP;
+    connection.ifindex = ifindex;
+    output_connection(ctx, &connection);
+
+    // The packet crossing the threshold is dropped like the following ones
+    if (blocked) {
+        return VERDICT_DROP;
+    }
+    return VERDICT_PASS;
+}
+
+SEC("xdp_metrics")
+int xdp_prog_main(struct xdp_md *ctx) {
 
-    bpf_map_push_elem(&tcp_connection_tracking_map, &connection, 0);
+    // Initialize data.
+    void *data_end = (void *)(long)ctx->data_end;
+    void *data = (void *)(long)ctx->data;
 
+    u16 protocol = 0;
+    u16 vlan_id = 0;
+    void *network_header = skip_ethernet_header(data, data_end, &protocol, &vlan_id);
+    if (!network_header) {
+        return XDP_DROP;
+    }
+
+    if (process_packet(ctx, network_header, data_end, protocol, vlan_id, ctx->ingress_ifindex) == VERDICT_DROP) {
+        return XDP_DROP;
+    }
     return XDP_PASS;
-}
\ No newline at end of file
+}
+
+// tc_prog_main is attached to the clsact ingress hook of interfaces without XDP support.
+SEC("classifier")
+int tc_prog_main(struct __sk_buff *skb) {
+
+    // Initialize data.
+    void *data_end = (void *)(long)skb->data_end;
+    void *data = (void *)(long)skb->data;
+
+    u16 protocol = 0;
+    u16 vlan_id = 0;
+    void *network_header = skip_ethernet_header(data, data_end, &protocol, &vlan_id);
+    if (!network_header) {
+        return TC_ACT_SHOT;
+    }
+    // The outermost VLAN tag is usually removed from the packet before TC runs and kept in the socket buffer
+    if (!vlan_id && skb->vlan_present) {
+        vlan_id = htons(skb->vlan_tci & VLAN_VID_MASK);
+    }
+
+    if (process_packet(skb, network_header, data_end, protocol, vlan_id, skb->ingress_ifindex) == VERDICT_DROP) {
+        return TC_ACT_SHOT;
+    }
+    return TC_ACT_OK;
+}
+
+// tc_prog_main_l3 is attached to the clsact ingress hook of layer 3 interfaces, like tunnels, whose packets start
+// directly with the network header.
+SEC("classifier")
+int tc_prog_main_l3(struct __sk_buff *skb) {
+
+    // Initialize data.
+    void *data_end = (void *)(long)skb->data_end;
+    void *data = (void *)(long)skb->data;
+
+    if (process_packet(skb, data, data_end, skb->protocol, 0, skb->ingress_ifindex) == VERDICT_DROP) {
+        return TC_ACT_SHOT;
+    }
+    return TC_ACT_OK;
+}
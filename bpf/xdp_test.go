@@ -0,0 +1,161 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	xdpDrop = 1
+	xdpPass = 2
+)
+
+// Scan techniques, as recorded in ip_metric.scan_types.
+const (
+	scanSYN = 0x01
+	scanACK = 0x10
+)
+
+// testConfig mirrors config in types.h.
+type testConfig struct {
+	Window         uint64
+	BootTime       uint64
+	Threshold      uint32
+	Enabled        uint8
+	UDPEnabled     uint8
+	SweepEnabled   uint8
+	_              [1]byte
+	SYNRate        uint32
+	SYNBurst       uint32
+	EphemeralPorts [2]uint16
+	_              [4]byte
+}
+
+// loadTestObjects loads the BPF objects, or skips the test if the process is not allowed to load BPF programs.
+func loadTestObjects(t *testing.T) *bpfObjects {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		t.Skipf("Removing the memlock limit: %v", err)
+	}
+	var objs bpfObjects
+	err := loadBpfObjects(&objs, nil)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("Loading BPF objects: %v", err)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = objs.Close() })
+	return &objs
+}
+
+// TCP flags of tcpPacket.
+const (
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// scanTypesOffset is the offset of scan_types in ip_metric.
+const scanTypesOffset = 30
+
+// tcpPacket builds an ethernet frame carrying an IPv4 TCP segment from 192.0.2.1 to 198.51.100.1 with the given ports,
+// flags and payload length.
+func tcpPacket(sourcePort, destPort uint16, flags byte, payloadLength int) []byte {
+	packet := make([]byte, 14+20+20+payloadLength)
+	binary.BigEndian.PutUint16(packet[12:14], unix.ETH_P_IP)
+
+	ip := packet[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(40+payloadLength))
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_TCP
+	copy(ip[12:16], []byte{192, 0, 2, 1})
+	copy(ip[16:20], []byte{198, 51, 100, 1})
+
+	tcp := packet[34:]
+	binary.BigEndian.PutUint16(tcp[0:2], sourcePort)
+	binary.BigEndian.PutUint16(tcp[2:4], destPort)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return packet
+}
+
+// synPacket builds an ethernet frame carrying an IPv4 TCP SYN from 192.0.2.1 to 198.51.100.1 on the given port.
+func synPacket(port uint16) []byte {
+	return tcpPacket(40000, port, tcpSYN, 0)
+}
+
+func TestTakeSYNToken(t *testing.T) {
+	objs := loadTestObjects(t)
+	config := testConfig{SYNRate: 1, SYNBurst: 2}
+	require.NoError(t, objs.ConfigMap.Put(uint32(0), config))
+
+	var verdicts []uint32
+	for i := 0; i < 3; i++ {
+		verdict, _, err := objs.XdpProgMain.Test(synPacket(80))
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			t.Skipf("Running XDP programs: %v", err)
+		}
+		require.NoError(t, err)
+		verdicts = append(verdicts, verdict)
+	}
+
+	// The burst lets the first two SYNs through, the bucket then refills at one SYN per second
+	assert.Equal(t, []uint32{xdpPass, xdpPass, xdpDrop}, verdicts)
+	var dropped []uint64
+	require.NoError(t, objs.SynDroppedMap.Lookup(uint32(0), &dropped))
+	var total uint64
+	for _, count := range dropped {
+		total += count
+	}
+	assert.Equal(t, uint64(1), total)
+}
+
+func TestClassifyACKProbe(t *testing.T) {
+	testCases := []struct {
+		name     string
+		packets  [][]byte
+		expected byte
+	}{
+		{"Probe", [][]byte{tcpPacket(40000, 80, tcpACK, 0)}, scanACK},
+		{"Handshake", [][]byte{tcpPacket(40000, 80, tcpSYN, 0), tcpPacket(40000, 80, tcpACK, 0)}, scanSYN},
+		{"OtherConnection", [][]byte{tcpPacket(40000, 80, tcpSYN, 0), tcpPacket(40001, 80, tcpACK, 0)}, scanSYN | scanACK},
+		{"OutgoingConnection", [][]byte{tcpPacket(443, 2000, tcpSYN|tcpACK, 0), tcpPacket(443, 2000, tcpACK, 0)}, 0},
+		{"ConnectionCarryingData", [][]byte{tcpPacket(40000, 80, tcpACK|tcpPSH, 10), tcpPacket(40000, 80, tcpACK, 0)}, 0},
+		{"PayloadWithoutPSH", [][]byte{tcpPacket(40000, 80, tcpACK, 10)}, 0},
+		{"EphemeralPort", [][]byte{tcpPacket(443, 40000, tcpACK, 0)}, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := loadTestObjects(t)
+			config := testConfig{EphemeralPorts: [2]uint16{32768, 60999}}
+			require.NoError(t, objs.ConfigMap.Put(uint32(0), config))
+
+			for _, packet := range tc.packets {
+				verdict, _, err := objs.XdpProgMain.Test(packet)
+				if errors.Is(err, ebpf.ErrNotSupported) {
+					t.Skipf("Running XDP programs: %v", err)
+				}
+				require.NoError(t, err)
+				assert.Equal(t, uint32(xdpPass), verdict)
+			}
+
+			var scanTypes byte
+			var values [][]byte
+			key := [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 0, 14: 2, 15: 1}
+			err := objs.IpMetricMap.Lookup(key, &values)
+			if !errors.Is(err, ebpf.ErrKeyNotExist) {
+				require.NoError(t, err)
+			}
+			for _, value := range values {
+				scanTypes |= value[scanTypesOffset]
+			}
+			assert.Equal(t, tc.expected, scanTypes)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package bpf
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf/link"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// XDPMode is the way the XDP program is attached to an interface.
+type XDPMode string
+
+const (
+	// XDPModeNative runs the program in the driver receive path, before socket buffers are allocated
+	XDPModeNative XDPMode = "native"
+	// XDPModeGeneric runs the program after socket buffers are allocated, it works with every driver but is slower
+	XDPModeGeneric XDPMode = "generic"
+	// XDPModeOffload runs the program on the NIC, only a few NICs support it
+	XDPModeOffload XDPMode = "offload"
+	// XDPModeAuto tries the native mode and falls back on the generic mode
+	XDPModeAuto XDPMode = "auto"
+	// xdpModeUnknown is reported when the mode of a pinned link reused from a previous run cannot be read
+	xdpModeUnknown XDPMode = "unknown"
+)
+
+var (
+	programAttached = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "teleportchallenge_program_attached",
+		Help: "Set to 1 for every interface the program is attached to, labelled with the XDP attach mode or \"tc\".",
+	}, []string{"interface", "mode"})
+)
+
+// ParseXDPMode validates an XDP attach mode.
+func ParseXDPMode(raw string) (XDPMode, error) {
+	switch mode := XDPMode(raw); mode {
+	case XDPModeNative, XDPModeGeneric, XDPModeOffload, XDPModeAuto:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown XDP mode %q, expected native, generic, offload or auto", raw)
+	}
+}
+
+// attachXDPMode attaches the XDP program in the given mode and returns the mode actually used. In auto mode the
+// native mode is tried first, drivers without XDP support make it fail and the generic mode is used instead.
+func attachXDPMode(options link.XDPOptions, mode XDPMode, name string) (link.Link, XDPMode, error) {
+	if mode != XDPModeAuto {
+		options.Flags = xdpFlags(mode)
+		xdpLink, err := link.AttachXDP(options)
+		if err != nil && mode == XDPModeOffload {
+			// The kernel only reports EINVAL or EOPNOTSUPP, without telling what the NIC rejected
+			err = fmt.Errorf("offloading the XDP program to %s: %w (offloaded programs cannot use the ring "+
+				"buffer, perf events nor maps shared with the host, use the native mode instead)", name, err)
+		}
+		return xdpLink, mode, err
+	}
+
+	options.Flags = xdpFlags(XDPModeNative)
+	xdpLink, err := link.AttachXDP(options)
+	if err == nil {
+		return xdpLink, XDPModeNative, nil
+	}
+	log.Printf("Attaching XDP program to %s in native mode failed, falling back on generic mode: %v", name, err)
+
+	options.Flags = xdpFlags(XDPModeGeneric)
+	xdpLink, err = link.AttachXDP(options)
+	return xdpLink, XDPModeGeneric, err
+}
+
+// xdpFlags converts an XDP mode into attach flags.
+func xdpFlags(mode XDPMode) link.XDPAttachFlags {
+	switch mode {
+	case XDPModeNative:
+		return link.XDPDriverMode
+	case XDPModeGeneric:
+		return link.XDPGenericMode
+	case XDPModeOffload:
+		return link.XDPOffloadMode
+	default:
+		return 0
+	}
+}
+
+// attachedXDPMode returns the mode of the XDP program attached to an interface, as reported by rtnetlink.
+func attachedXDPMode(iface int) XDPMode {
+	netlinkLink, err := netlink.LinkByIndex(iface)
+	if err != nil {
+		log.Printf("Error reading the XDP mode of interface %d: %v", iface, err)
+		return xdpModeUnknown
+	}
+	xdp := netlinkLink.Attrs().Xdp
+	if xdp == nil {
+		return xdpModeUnknown
+	}
+	return xdpModeFromAttached(xdp.AttachMode)
+}
+
+// xdpModeFromAttached converts the IFLA_XDP_ATTACHED value of an interface into an XDP mode.
+func xdpModeFromAttached(attachMode uint32) XDPMode {
+	switch attachMode {
+	case nl.XDP_ATTACHED_DRV:
+		return XDPModeNative
+	case nl.XDP_ATTACHED_SKB:
+		return XDPModeGeneric
+	case nl.XDP_ATTACHED_HW:
+		return XDPModeOffload
+	default:
+		return xdpModeUnknown
+	}
+}
+
+// xdpModeMatches tells if a program attached in the current mode satisfies the requested mode.
+func xdpModeMatches(requested, current XDPMode) bool {
+	if requested == XDPModeAuto {
+		return current == XDPModeNative || current == XDPModeGeneric
+	}
+	return requested == current
+}
@@ -0,0 +1,38 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestXDPModeFromAttached(t *testing.T) {
+	assert.Equal(t, XDPModeNative, xdpModeFromAttached(nl.XDP_ATTACHED_DRV))
+	assert.Equal(t, XDPModeGeneric, xdpModeFromAttached(nl.XDP_ATTACHED_SKB))
+	assert.Equal(t, XDPModeOffload, xdpModeFromAttached(nl.XDP_ATTACHED_HW))
+	assert.Equal(t, xdpModeUnknown, xdpModeFromAttached(nl.XDP_ATTACHED_NONE))
+}
+
+func TestXDPModeMatches(t *testing.T) {
+	testCases := []struct {
+		name      string
+		requested XDPMode
+		current   XDPMode
+		expected  bool
+	}{
+		{"SameMode", XDPModeNative, XDPModeNative, true},
+		{"OtherMode", XDPModeNative, XDPModeGeneric, false},
+		{"AutoNative", XDPModeAuto, XDPModeNative, true},
+		{"AutoGeneric", XDPModeAuto, XDPModeGeneric, true},
+		{"AutoOffload", XDPModeAuto, XDPModeOffload, false},
+		{"AutoUnknown", XDPModeAuto, xdpModeUnknown, false},
+		{"Unknown", XDPModeGeneric, xdpModeUnknown, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, xdpModeMatches(tc.requested, tc.current))
+		})
+
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/hugoshaka/teleport-challenge/pkg/admin"
+)
+
+// isClientCommand tells if the arguments call a subcommand rather than starting the daemon.
+func isClientCommand(arguments docopt.Opts) bool {
+	for _, command := range []string{"bans", "denylist", "stats", "top-talkers"} {
+		if called, _ := arguments.Bool(command); called {
+			return true
+		}
+	}
+	return false
+}
+
+// runClientCommand runs a subcommand against the daemon listening on the socket.
+func runClientCommand(arguments docopt.Opts) error {
+	socketPath, _ := arguments.String("--socket")
+	client := admin.NewClient(socketPath)
+
+	denylist, _ := arguments.Bool("denylist")
+	list, _ := arguments.Bool("list")
+	add, _ := arguments.Bool("add")
+	remove, _ := arguments.Bool("remove")
+	stats, _ := arguments.Bool("stats")
+	ip, _ := arguments.String("<ip>")
+	prefix, _ := arguments.String("<prefix>")
+
+	switch {
+	case denylist && list:
+		return listDenied(client)
+	case denylist && add:
+		denied, err := client.Deny(prefix)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s denied\n", denied.Prefix)
+		return nil
+	case denylist && remove:
+		if err := client.RemoveDenied(prefix); err != nil {
+			return err
+		}
+		fmt.Printf("%s removed from the denylist\n", prefix)
+		return nil
+	case list:
+		return listBans(client)
+	case add:
+		duration, _ := arguments.String("--for")
+		reason, _ := arguments.String("--reason")
+		return addBan(client, &admin.BanRequest{IP: ip, Duration: duration, Reason: reason})
+	case remove:
+		if err := client.RemoveBan(ip); err != nil {
+			return err
+		}
+		fmt.Printf("%s unbanned\n", ip)
+		return nil
+	case stats:
+		return printStats(client)
+	default:
+		limit, err := arguments.Int("--limit")
+		if err != nil {
+			return fmt.Errorf("invalid limit: %w", err)
+		}
+		return listTopTalkers(client, limit)
+	}
+}
+
+func listBans(client *admin.Client) error {
+	bans, err := client.ListBans()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "IP\tBLOCKED AT\tDURATION\tEXPIRES AT\tREASON")
+	for _, ban := range bans {
+		expiresAt := "never"
+		if ban.ExpiresAt != nil {
+			expiresAt = ban.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", ban.IP, ban.BlockTime.Local().Format(time.RFC3339), ban.Duration, expiresAt, ban.Reason)
+	}
+	return writer.Flush()
+}
+
+func addBan(client *admin.Client, request *admin.BanRequest) error {
+	ban, err := client.AddBan(request)
+	if err != nil {
+		return err
+	}
+	if ban.ExpiresAt == nil {
+		fmt.Printf("%s banned permanently\n", ban.IP)
+		return nil
+	}
+	fmt.Printf("%s banned until %s\n", ban.IP, ban.ExpiresAt.Local().Format(time.RFC3339))
+	return nil
+}
+
+func listDenied(client *admin.Client) error {
+	denied, err := client.ListDenied()
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PREFIX\tSOURCE")
+	for _, entry := range denied {
+		fmt.Fprintf(writer, "%s\t%s\n", entry.Prefix, entry.Source)
+	}
+	return writer.Flush()
+}
+
+func printStats(client *admin.Client) error {
+	stats, err := client.Stats()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(stats.Metrics))
+	for name := range stats.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "banned_ips\t%d\n", stats.BannedIPs)
+	for _, name := range names {
+		fmt.Fprintf(writer, "%s\t%v\n", name, stats.Metrics[name])
+	}
+	return writer.Flush()
+}
+
+func listTopTalkers(client *admin.Client, limit int) error {
+	talkers, err := client.TopTalkers(limit)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "IP\tVLAN\tSYNS\tPORTS")
+	for _, talker := range talkers {
+		vlan := "-"
+		if talker.VLAN != 0 {
+			vlan = fmt.Sprint(talker.VLAN)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%d\n", talker.IP, vlan, talker.SYNs, talker.Ports)
+	}
+	return writer.Flush()
+}
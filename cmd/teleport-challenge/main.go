@@ -9,91 +9,346 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/hugoshaka/teleport-challenge/bpf"
+	"github.com/hugoshaka/teleport-challenge/pkg/admin"
+	"github.com/hugoshaka/teleport-challenge/pkg/iplist"
 	"github.com/hugoshaka/teleport-challenge/pkg/watchers"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
+	"inet.af/netaddr"
 )
 
 const (
 	metricsPort = 8080
+	// maxTopTalkers is the number of IPs kept for the top-talkers subcommand
+	maxTopTalkers = 100
+	// kernelBansBuffer is the number of bans issued by the XDP program that can wait for the blocking watcher
+	kernelBansBuffer = 1024
 )
 
 var (
 	monitoringEndpoint  = fmt.Sprintf(":%d", metricsPort)
 	metricServerTimeout = 5 * time.Second
+	socketDialTimeout   = time.Second
 )
 
+// errSocketInUse is returned when another daemon answers on the admin socket.
+var errSocketInUse = errors.New("another daemon is already listening on the socket")
+
 func main() {
 	usage := `Teleport challenge.
-Leverages eBPF to log all incoming IPv4 TCP connections and block scanning IPs from contacting the server.
+Leverages eBPF to log all incoming IPv4 and IPv6 TCP connections and UDP flows and block scanning IPs from contacting
+the server.
 
 Usage:
-  teleport-challenge [--interface=<if>] [--tracking-period=<tp>] [--detect-scan-period=<dp>] [--threshold=<n>]
+  teleport-challenge [--interface=<if>...] [--detect-scan-period=<dp>] [--detect-interval=<di>]
+                     [--threshold=<n>] [--vlan-threshold=<vn>] [--udp-threshold=<un>]
+                     [--sweep-threshold=<st>] [--slow-scan-threshold=<ss>]
+                     [--syn-rate=<sr>] [--syn-burst=<sb>] [--flood-threshold=<ft>]
+                     [--ban-duration=<bd>] [--offence-decay=<od>]
+                     [--allowlist=<cidrs>] [--allowlist-file=<file>] [--denylist-file=<file>]
+                     [--log-format=<format>] [--dry-run] [--admin-token-file=<file>] [--admin-listen=<addr>]
+                     [--socket=<path>]
+                     [--pin-path=<path>] [--state-file=<file>] [--hook=<hook>] [--xdp-mode=<mode>]
+  teleport-challenge bans list [--socket=<path>]
+  teleport-challenge bans add <ip> [--for=<duration>] [--reason=<reason>] [--socket=<path>]
+  teleport-challenge bans remove <ip> [--socket=<path>]
+  teleport-challenge denylist list [--socket=<path>]
+  teleport-challenge denylist add <prefix> [--socket=<path>]
+  teleport-challenge denylist remove <prefix> [--socket=<path>]
+  teleport-challenge stats [--socket=<path>]
+  teleport-challenge top-talkers [--limit=<n>] [--socket=<path>]
   teleport-challenge -h | --help
   teleport-challenge --version
 
 Options:
   -h --help                     Show this screen.
   --version                     Show version.
-  -i --interface=<if>           Interface to watch [default: lo].
-  -t --tracking-period=<tp>     Poll interval to read new connections [default: 1s].
-  -d --detect-scan-period=<dp>  Poll interval to detect port scans [default: 1m].
-  -n --threshold=<n>            IPs connecting to more ports than <n> in the last <dp> will be banned [default: 3].`
+  -i --interface=<if>           Interface to watch, can be repeated and can be a glob pattern like "eth*" [default: lo].
+  -d --detect-scan-period=<dp>  Length of the sliding window port scans are detected in [default: 1m].
+  --detect-interval=<di>        Interval between two evaluations of the sliding window. Each one reads the whole
+                                metric map, up to 65536 IPs with a value per CPU, raise it on busy hosts [default: 1s].
+  -n --threshold=<n>            IPs connecting to more ports than <n> within any <dp> window will be banned, at most 9
+                                as only the last 10 ports of each IP are kept [default: 3].
+  --vlan-threshold=<vn>         Comma-separated per-VLAN thresholds overriding <n> for IPs seen on a VLAN, for
+                                example "100:5,200:2". Thresholds must not exceed 9.
+  --udp-threshold=<un>          IPs sending datagrams to more UDP ports of the host than <un> within any <dp> window
+                                will be banned, at most 9. 0 disables UDP scan detection [default: 0].
+  --sweep-threshold=<st>        IPs probing more destination IPs than <st> within any <dp> window will be banned, 0
+                                disables sweep detection [default: 0].
+  --slow-scan-threshold=<ss>    IPs connecting to more distinct TCP and UDP ports than <ss> over 24 hours will be
+                                banned, 0 disables slow scan detection [default: 0].
+  --syn-rate=<sr>               SYNs per second the XDP program lets through for each IP, the excess is dropped. 0
+                                disables rate limiting [default: 0].
+  --syn-burst=<sb>              SYNs an IP can send at once before being rate limited [default: 100].
+  --flood-threshold=<ft>        IPs sending more SYNs per second than <ft> during a <di> interval will be banned, 0
+                                disables SYN flood detection [default: 0].
+  -b --ban-duration=<bd>        Comma-separated ban durations for successive offences of an IP, the last one is
+                                reused for further offences and 0 means permanent [default: 10m,1h,24h,0].
+  --offence-decay=<od>          Offences of an IP are forgotten after <od> without offending once unbanned [default: 24h].
+  -a --allowlist=<cidrs>        Comma-separated IPs or CIDRs that are never blocked.
+  --allowlist-file=<file>       File listing IPs or CIDRs that are never blocked, one per line.
+  --denylist-file=<file>        File listing IPs or CIDRs that are always dropped, one per line. The file is reloaded
+                                when receiving SIGHUP, prefixes can also be added at runtime with "denylist add".
+  --log-format=<format>         Output connections and ban decisions as "text" log lines or as "json" objects on stdout
+                                [default: text].
+  --dry-run                     Detect and log port scans without blocking the scanning IPs.
+  --admin-token-file=<file>     Enable the admin API over TCP on <addr>, authenticated with the token read from
+                                <file>.
+  --admin-listen=<addr>         Address the admin API listens on when --admin-token-file is set, the token travels in
+                                clear text so only listen on a trusted network [default: 127.0.0.1:8081].
+  --socket=<path>               Unix socket the daemon serves the admin API on for the subcommands
+                                [default: /run/teleport-challenge.sock].
+  --pin-path=<path>             Pin the BPF maps and the XDP link in <path>, a bpffs directory, so bans survive
+                                restarts and packets are still filtered while the daemon is restarting.
+  --hook=<hook>                 Attach the program with "xdp" or to the TC clsact ingress hook with "tc", for devices
+                                where XDP is unavailable [default: xdp].
+  --xdp-mode=<mode>             XDP attach mode: "native", "generic", "offload" or "auto" to try native mode and fall
+                                back on generic mode [default: auto].
+  --state-file=<file>           Save the bans and the slow scan history to <file> every <dp> and on shutdown, and
+                                restore them on startup.
+  --for=<duration>              Ban duration, the ban is permanent if not set.
+  --reason=<reason>             Reason of the ban.
+  --limit=<n>                   Number of IPs to list [default: 10].`
+
+	arguments, _ := docopt.ParseDoc(usage)
 
-	// Initialize context and parse arguments
+	// Subcommands talk to the running daemon
+	if isClientCommand(arguments) {
+		if err := runClientCommand(arguments); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	// Initialize context
 	ctx, cancel := makeContext()
 	defer cancel()
 
-	arguments, _ := docopt.ParseDoc(usage)
-
-	rawTrackingPeriod, _ := arguments.String("--tracking-period")
-	trackingPeriod, _ := time.ParseDuration(rawTrackingPeriod)
 	rawBlockingPeriod, _ := arguments.String("--detect-scan-period")
 	blockingPeriod, _ := time.ParseDuration(rawBlockingPeriod)
+	rawDetectInterval, _ := arguments.String("--detect-interval")
 	blockThreshold, _ := arguments.Int("--threshold")
-	interfaceName, _ := arguments.String("--interface")
+	rawVLANThresholds, _ := arguments.String("--vlan-threshold")
+	udpThreshold, _ := arguments.Int("--udp-threshold")
+	sweepThreshold, _ := arguments.Int("--sweep-threshold")
+	slowScanThreshold, _ := arguments.Int("--slow-scan-threshold")
+	synRate, _ := arguments.Int("--syn-rate")
+	synBurst, _ := arguments.Int("--syn-burst")
+	rawFloodThreshold, _ := arguments.String("--flood-threshold")
+	rawBanDurations, _ := arguments.String("--ban-duration")
+	rawOffenceDecay, _ := arguments.String("--offence-decay")
+	offenceDecay, _ := time.ParseDuration(rawOffenceDecay)
+
+	rawAllowlist, _ := arguments.String("--allowlist")
+	allowlistFile, _ := arguments.String("--allowlist-file")
+	denylistFile, _ := arguments.String("--denylist-file")
+	logFormat, _ := arguments.String("--log-format")
+	dryRun, _ := arguments.Bool("--dry-run")
+	adminTokenFile, _ := arguments.String("--admin-token-file")
+	adminListen, _ := arguments.String("--admin-listen")
+	socketPath, _ := arguments.String("--socket")
+	pinPath, _ := arguments.String("--pin-path")
+	stateFile, _ := arguments.String("--state-file")
+	rawHook, _ := arguments.String("--hook")
+	rawXDPMode, _ := arguments.String("--xdp-mode")
+
+	banDurations, err := parseDurations(rawBanDurations)
+	if err != nil {
+		log.Fatalf("Error parsing ban durations: %v", err)
+	}
+
+	hook, err := bpf.ParseHook(rawHook)
+	if err != nil {
+		log.Fatalf("Error parsing hook: %v", err)
+	}
+
+	detectInterval, err := time.ParseDuration(rawDetectInterval)
+	if err != nil || detectInterval <= 0 {
+		log.Fatalf("Error parsing detection interval %q", rawDetectInterval)
+	}
+
+	// Only the last ports of an IP are kept, a higher threshold would never be crossed
+	if blockThreshold < 0 || blockThreshold > watchers.MaxPortThreshold {
+		log.Fatalf("Error: --threshold must be between 0 and %d", watchers.MaxPortThreshold)
+	}
+	if udpThreshold < 0 || udpThreshold > watchers.MaxPortThreshold {
+		log.Fatalf("Error: --udp-threshold must be between 0 and %d", watchers.MaxPortThreshold)
+	}
+
+	if synRate < 0 || synBurst < 1 {
+		log.Fatal("Error: --syn-rate must not be negative and --syn-burst must be at least 1")
+	}
+	floodThreshold, err := strconv.ParseFloat(rawFloodThreshold, 64)
+	if err != nil || floodThreshold < 0 {
+		log.Fatalf("Error parsing flood threshold %q", rawFloodThreshold)
+	}
+
+	xdpMode, err := bpf.ParseXDPMode(rawXDPMode)
+	if err != nil {
+		log.Fatalf("Error parsing XDP mode: %v", err)
+	}
+
+	vlanThresholds, err := parseVLANThresholds(rawVLANThresholds)
+	if err != nil {
+		log.Fatalf("Error parsing VLAN thresholds: %v", err)
+	}
 
-	iface, err := findInterface(interfaceName)
+	allowlist, err := buildAllowlist(rawAllowlist, allowlistFile)
+	if err != nil {
+		log.Fatalf("Error parsing allowlist: %v", err)
+	}
+	var adminToken string
+	if adminTokenFile != "" {
+		adminToken, err = readToken(adminTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading admin token: %v", err)
+		}
+	}
+	interfacePatterns, _ := arguments["--interface"].([]string)
+
+	ifaces, err := findInterfaces(interfacePatterns)
 
 	if err != nil {
 		log.Fatalf("Error recovering interface: %v", err)
 	}
 
+	events, err := watchers.NewEventLogger(logFormat, os.Stdout)
+	if err != nil {
+		log.Fatalf("Error setting up event logging: %v", err)
+	}
+
+	if dryRun {
+		log.Println("Running in dry run mode, port scans will be logged but not blocked")
+	}
+
+	// Listen on the Unix socket before loading the BPF objects, so a second daemon gives up before replacing the
+	// program of the running one
+	socketListener, err := listenSocket(socketPath)
+	if errors.Is(err, errSocketInUse) {
+		log.Fatalf("Error listening on %s: %v", socketPath, err)
+	}
+	if err != nil {
+		log.Printf("Error listening on %s, subcommands will not be available: %v", socketPath, err)
+	}
+
 	// Load BPF objects
-	trackingMap, metricMap, blockingMap := bpf.LoadAndAttach(iface)
+	loader, err := bpf.LoadAndAttach(ifaces, bpf.LoaderOptions{
+		Allowlist: allowlist,
+		PinPath:   pinPath,
+		Hook:      hook,
+		XDPMode:   xdpMode,
+	})
+	if err != nil {
+		log.Fatalf("Error loading BPF objects: %v", err)
+	}
+	maps := loader.Maps()
 
 	// Initialize the watchers
-	trackingWatcher := watchers.NewTrackingWatcher(trackingMap, trackingPeriod)
-	blockingWatcher := watchers.NewBlockingWatcher(metricMap, blockingMap, blockingPeriod, blockThreshold)
+	kernelBans := make(chan netaddr.IP, kernelBansBuffer)
+	trackingWatcher := watchers.NewTrackingWatcher(maps.Connections, maps.LostConnections, events, kernelBans)
+	banPolicy := watchers.NewBanPolicy(banDurations, offenceDecay)
+	blocklist := watchers.NewBlocklist(maps.Blocking, maps.BanInfo, banPolicy)
+	denylist := watchers.NewDenylist(maps.Denied)
+	topTalkers := watchers.NewTopTalkers(maxTopTalkers)
+	var slowScans *watchers.SlowScanTracker
+	if slowScanThreshold > 0 {
+		slowScans = watchers.NewSlowScanTracker()
+	}
+	if stateFile != "" {
+		if err := restoreState(blocklist, slowScans, stateFile); err != nil {
+			_ = loader.Close()
+			log.Fatalf("Error restoring the state: %v", err)
+		}
+	}
+	blockingWatcher := watchers.NewBlockingWatcher(maps, blocklist, watchers.BlockingOptions{
+		Window:            blockingPeriod,
+		Interval:          detectInterval,
+		Threshold:         blockThreshold,
+		UDPThreshold:      udpThreshold,
+		SweepThreshold:    sweepThreshold,
+		SlowScanThreshold: slowScanThreshold,
+		VLANThresholds:    vlanThresholds,
+		Policy:            banPolicy,
+		Allowlist:         allowlist,
+		Events:            events,
+		DryRun:            dryRun,
+		TopTalkers:        topTalkers,
+		SlowScans:         slowScans,
+		KernelBans:        kernelBans,
+		SYNRate:           uint32(synRate),
+		SYNBurst:          uint32(synBurst),
+		FloodThreshold:    floodThreshold,
+	})
+	interfaceWatcher := watchers.NewInterfaceWatcher(loader, interfacePatterns, ifaces)
+	expiringWatcher := watchers.NewExpiringWatcher(blocklist, blockingPeriod, banPolicy, events)
 
 	// Run everything
 	workGroup, ctx := errgroup.WithContext(ctx)
 	workGroup.Go(func() error { return trackingWatcher.Run(ctx) })
 	workGroup.Go(func() error { return blockingWatcher.Run(ctx) })
+	workGroup.Go(func() error { return expiringWatcher.Run(ctx) })
+	workGroup.Go(func() error { return interfaceWatcher.Run(ctx) })
+	if udpThreshold > 0 {
+		localAddressWatcher := watchers.NewLocalAddressWatcher(maps.LocalIPs)
+		workGroup.Go(func() error { return localAddressWatcher.Run(ctx) })
+	}
+	if stateFile != "" {
+		snapshotWatcher := watchers.NewSnapshotWatcher(blocklist, slowScans, stateFile, blockingPeriod)
+		workGroup.Go(func() error { return snapshotWatcher.Run(ctx) })
+	}
+	if denylistFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		denylistWatcher := watchers.NewDenylistWatcher(denylist, denylistFile, reload)
+		workGroup.Go(func() error { return denylistWatcher.Run(ctx) })
+	}
 
 	// Setup monitoring server
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	server := &http.Server{
-		Addr:              monitoringEndpoint,
-		Handler:           mux,
-		IdleTimeout:       metricServerTimeout,
-		ReadTimeout:       metricServerTimeout,
-		WriteTimeout:      metricServerTimeout,
-		ReadHeaderTimeout: metricServerTimeout,
-	}
+	server := newServer(monitoringEndpoint, mux)
 	workGroup.Go(func() error { return server.ListenAndServe() })
-	// To have a graceful shutdown we register a coroutine waiting for context cancellation and stopping the server
+
+	// Setup the admin API on its own address, so it is not exposed with the metrics
+	var adminServer *http.Server
+	if adminToken != "" {
+		adminMux := http.NewServeMux()
+		admin.NewHandler(blocklist, denylist, topTalkers, events, adminToken).Register(adminMux)
+		adminServer = newServer(adminListen, adminMux)
+		workGroup.Go(func() error { return adminServer.ListenAndServe() })
+	}
+
+	// Setup the admin API on the Unix socket, access is restricted by the socket permissions
+	var socketServer *http.Server
+	if socketListener != nil {
+		socketMux := http.NewServeMux()
+		admin.NewHandler(blocklist, denylist, topTalkers, events, "").Register(socketMux)
+		socketServer = newServer("", socketMux)
+		workGroup.Go(func() error { return socketServer.Serve(socketListener) })
+	}
+
+	// To have a graceful shutdown we register a coroutine waiting for context cancellation and stopping the servers
 	go func() {
 		if <-ctx.Done(); true {
 			stopCtx, cancel := context.WithTimeout(context.Background(), metricServerTimeout)
 			defer cancel()
 			log.Println("Stopping monitoring server")
 			_ = server.Shutdown(stopCtx)
+			if adminServer != nil {
+				_ = adminServer.Shutdown(stopCtx)
+			}
+			if socketServer != nil {
+				_ = socketServer.Shutdown(stopCtx)
+			}
 		}
 	}()
 
@@ -108,16 +363,21 @@ Options:
 			exitCode = 1
 		}
 	}
+	// The watchers are stopped, the maps can be closed
+	if err := loader.Close(); err != nil {
+		log.Printf("Error closing BPF objects: %v", err)
+		exitCode = 1
+	}
 	os.Exit(exitCode)
 }
 
-// makeContext creates a context, traps Interrupts and cancels the context if needed.
+// makeContext creates a context, traps Interrupts and SIGTERM, and cancels the context if needed.
 func makeContext() (context.Context, func()) {
 	ctx := context.Background()
 
 	ctx, cancel := context.WithCancel(ctx)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		select {
 		case <-c:
@@ -131,15 +391,164 @@ func makeContext() (context.Context, func()) {
 	}
 }
 
-func findInterface(name string) (int, error) {
+// restoreState blocks again the IPs saved in the state file whose ban has not expired yet, and restores the slow scan
+// history unless slowScans is nil.
+func restoreState(blocklist *watchers.Blocklist, slowScans *watchers.SlowScanTracker, stateFile string) error {
+	bans, err := watchers.LoadSnapshot(stateFile, time.Now(), slowScans)
+	if err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		if err := blocklist.Restore(ban); err != nil {
+			return err
+		}
+	}
+	log.Printf("%d bans restored from %s", len(bans), stateFile)
+	return nil
+}
+
+// newServer creates an HTTP server with the monitoring server timeouts.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		IdleTimeout:       metricServerTimeout,
+		ReadTimeout:       metricServerTimeout,
+		WriteTimeout:      metricServerTimeout,
+		ReadHeaderTimeout: metricServerTimeout,
+	}
+}
+
+// listenSocket listens on a Unix socket only accessible to the current user, replacing a stale socket if any. It
+// returns errSocketInUse if another process answers on the socket.
+func listenSocket(path string) (net.Listener, error) {
+	// Only remove the socket if nothing answers on it, it might belong to another running daemon
+	if conn, err := net.DialTimeout("unix", path, socketDialTimeout); err == nil {
+		_ = conn.Close()
+		return nil, errSocketInUse
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	// The socket is created with the permissions allowed by the umask, restrict them before it exists rather than
+	// changing them afterwards, which would let other users connect in between
+	oldMask := syscall.Umask(0177)
+	defer syscall.Umask(oldMask)
+	return net.Listen("unix", path)
+}
+
+// findInterfaces returns the interfaces whose name matches one of the patterns, see filepath.Match for the syntax.
+// Every pattern must match at least one interface.
+func findInterfaces(patterns []string) ([]net.Interface, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	for _, iface := range ifaces {
-		if iface.Name == name {
-			return iface.Index, nil
+	var found []net.Interface
+	for _, pattern := range patterns {
+		matches := 0
+		for _, iface := range ifaces {
+			matched, err := filepath.Match(pattern, iface.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+			}
+			if matched {
+				found = appendInterface(found, iface)
+				matches++
+			}
+		}
+		if matches == 0 {
+			return nil, fmt.Errorf("no interface matches %q", pattern)
+		}
+	}
+	return found, nil
+}
+
+// appendInterface adds an interface to the list unless it is already there.
+func appendInterface(ifaces []net.Interface, iface net.Interface) []net.Interface {
+	for _, existing := range ifaces {
+		if existing.Index == iface.Index {
+			return ifaces
 		}
 	}
-	return 0, errors.New("interface not found")
+	return append(ifaces, iface)
+}
+
+// parseDurations parses a comma-separated list of durations such as "10m,1h,0".
+func parseDurations(raw string) ([]time.Duration, error) {
+	var durations []time.Duration
+	for _, rawDuration := range strings.Split(raw, ",") {
+		duration, err := time.ParseDuration(strings.TrimSpace(rawDuration))
+		if err != nil {
+			return nil, err
+		}
+		if duration < 0 {
+			return nil, fmt.Errorf("negative duration %s", duration)
+		}
+		durations = append(durations, duration)
+	}
+	return durations, nil
+}
+
+// parseVLANThresholds parses a comma-separated list of per-VLAN thresholds such as "100:5,200:2".
+func parseVLANThresholds(raw string) (map[uint16]int, error) {
+	thresholds := make(map[uint16]int)
+	if raw == "" {
+		return thresholds, nil
+	}
+	for _, rawThreshold := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rawThreshold), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid VLAN threshold %q, expected <vlan>:<threshold>", rawThreshold)
+		}
+		vlanID, err := strconv.ParseUint(parts[0], 10, 12)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VLAN ID %q: %w", parts[0], err)
+		}
+		threshold, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %w", parts[1], err)
+		}
+		// Only the last ports of an IP are kept, a higher threshold would never be crossed
+		if threshold < 0 || threshold > watchers.MaxPortThreshold {
+			return nil, fmt.Errorf("invalid threshold %d for VLAN %d, it must be between 0 and %d", threshold, vlanID, watchers.MaxPortThreshold)
+		}
+		thresholds[uint16(vlanID)] = threshold
+	}
+	return thresholds, nil
+}
+
+// buildAllowlist merges the IPs and CIDRs allowlisted on the command line and in the allowlist file.
+func buildAllowlist(rawAllowlist, allowlistFile string) (*netaddr.IPSet, error) {
+	var builder netaddr.IPSetBuilder
+
+	prefixes, err := iplist.Parse(strings.Split(rawAllowlist, ","))
+	if err != nil {
+		return nil, err
+	}
+	if allowlistFile != "" {
+		filePrefixes, err := iplist.ReadFile(allowlistFile)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, filePrefixes...)
+	}
+
+	for _, prefix := range prefixes {
+		builder.AddPrefix(prefix)
+	}
+	return builder.IPSet()
+}
+
+// readToken reads the admin API token from a file, ignoring surrounding whitespace.
+func readToken(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
 }
@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	clientTimeout = 10 * time.Second
+	// socketURL is the base URL of requests sent through the Unix socket, the host is ignored
+	socketURL = "http://unix"
+)
+
+// Client talks to the admin API of a running daemon through its Unix socket.
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{
+		httpClient: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// ListBans returns the blocked IPs.
+func (c *Client) ListBans() ([]*BanResponse, error) {
+	var bans []*BanResponse
+	err := c.do(http.MethodGet, bansPath, nil, http.StatusOK, &bans)
+	return bans, err
+}
+
+// AddBan blocks an IP.
+func (c *Client) AddBan(request *BanRequest) (*BanResponse, error) {
+	var ban BanResponse
+	if err := c.do(http.MethodPost, bansPath, request, http.StatusCreated, &ban); err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+// RemoveBan unblocks an IP.
+func (c *Client) RemoveBan(ip string) error {
+	return c.do(http.MethodDelete, bansPath+"/"+url.PathEscape(ip), nil, http.StatusNoContent, nil)
+}
+
+// ListDenied returns the prefixes of the denylist.
+func (c *Client) ListDenied() ([]*DeniedPrefixResponse, error) {
+	var denied []*DeniedPrefixResponse
+	err := c.do(http.MethodGet, denylistPath, nil, http.StatusOK, &denied)
+	return denied, err
+}
+
+// Deny adds an IP or CIDR prefix to the denylist.
+func (c *Client) Deny(prefix string) (*DeniedPrefixResponse, error) {
+	var denied DeniedPrefixResponse
+	if err := c.do(http.MethodPost, denylistPath, &DenyRequest{Prefix: prefix}, http.StatusCreated, &denied); err != nil {
+		return nil, err
+	}
+	return &denied, nil
+}
+
+// RemoveDenied removes a prefix added with Deny from the denylist.
+func (c *Client) RemoveDenied(prefix string) error {
+	return c.do(http.MethodDelete, denylistPath+"/"+url.PathEscape(prefix), nil, http.StatusNoContent, nil)
+}
+
+// Stats returns a summary of the state of the firewall.
+func (c *Client) Stats() (*StatsResponse, error) {
+	var stats StatsResponse
+	if err := c.do(http.MethodGet, statsPath, nil, http.StatusOK, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// TopTalkers returns up to limit IPs that sent the most SYN packets during the last detection period.
+func (c *Client) TopTalkers(limit int) ([]*TalkerResponse, error) {
+	var talkers []*TalkerResponse
+	err := c.do(http.MethodGet, topTalkersPath+"?limit="+strconv.Itoa(limit), nil, http.StatusOK, &talkers)
+	return talkers, err
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into out, unless it is nil.
+// Responses with another status than expectedStatus are turned into errors.
+func (c *Client) do(method, path string, body interface{}, expectedStatus int, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, socketURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("is the daemon running? %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != expectedStatus {
+		var apiError errorResponse
+		if err := json.NewDecoder(response.Body).Decode(&apiError); err != nil || apiError.Error == "" {
+			return fmt.Errorf("unexpected response: %s", response.Status)
+		}
+		return errors.New(apiError.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
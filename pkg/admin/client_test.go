@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveSocket serves handler on a Unix socket and returns a Client connected to it.
+func serveSocket(t *testing.T, handler http.Handler) *Client {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	server := &http.Server{Handler: handler}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return NewClient(socketPath)
+}
+
+func TestClientTopTalkers(t *testing.T) {
+	client := serveSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, topTalkersPath, r.URL.Path)
+		assert.Equal(t, "5", r.URL.Query().Get("limit"))
+		writeJSON(w, http.StatusOK, []*TalkerResponse{{IP: "192.0.2.1", SYNs: 300, Ports: 12}})
+	}))
+
+	talkers, err := client.TopTalkers(5)
+
+	require.NoError(t, err)
+	assert.Equal(t, []*TalkerResponse{{IP: "192.0.2.1", SYNs: 300, Ports: 12}}, talkers)
+}
+
+func TestClientDeny(t *testing.T) {
+	client := serveSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request DenyRequest
+		assert.Equal(t, denylistPath, r.URL.Path)
+		assert.Equal(t, http.MethodPost, r.Method)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal(t, "192.0.2.0/24", request.Prefix)
+		writeJSON(w, http.StatusCreated, &DeniedPrefixResponse{Prefix: request.Prefix, Source: "manual"})
+	}))
+
+	denied, err := client.Deny("192.0.2.0/24")
+
+	require.NoError(t, err)
+	assert.Equal(t, &DeniedPrefixResponse{Prefix: "192.0.2.0/24", Source: "manual"}, denied)
+}
+
+func TestClientRemoveDenied(t *testing.T) {
+	client := serveSocket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, denylistPath+"/2001:db8::/32", r.URL.Path)
+		assert.Equal(t, http.MethodDelete, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	err := client.RemoveDenied("2001:db8::/32")
+
+	assert.NoError(t, err)
+}
+
+func TestClientErrors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected string
+	}{
+		{
+			"APIError",
+			func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusNotFound, errorResponse{Error: "ip is not blocked"})
+			},
+			"ip is not blocked",
+		},
+		{
+			"UnexpectedResponse",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			"unexpected response: 502 Bad Gateway",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := serveSocket(t, tc.handler)
+
+			err := client.RemoveBan("192.0.2.1")
+
+			assert.EqualError(t, err, tc.expected)
+		})
+
+	}
+}
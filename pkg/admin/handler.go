@@ -0,0 +1,398 @@
+// Package admin exposes an HTTP API to inspect the XDP firewall and manage its bans and denylist, as well as a client
+// for it.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hugoshaka/teleport-challenge/pkg/iplist"
+	"github.com/hugoshaka/teleport-challenge/pkg/watchers"
+	"github.com/prometheus/client_golang/prometheus"
+	"inet.af/netaddr"
+)
+
+const (
+	bansPath       = "/bans"
+	denylistPath   = "/denylist"
+	statsPath      = "/stats"
+	topTalkersPath = "/top-talkers"
+	// metricsPrefix is the prefix of the Prometheus metrics reported by /stats
+	metricsPrefix = "teleportchallenge_"
+	// defaultReason is the reason of manual bans when the operator does not give one
+	defaultReason = "manual"
+)
+
+// BanRequest is the body of a POST /bans request.
+type BanRequest struct {
+	IP string `json:"ip"`
+	// Duration of the ban such as "1h", empty or "0" means permanent
+	Duration string `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// BanResponse describes a ban.
+type BanResponse struct {
+	IP        string     `json:"ip"`
+	BlockTime time.Time  `json:"block_time"`
+	Duration  string     `json:"duration"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Reason    string     `json:"reason"`
+}
+
+// DenyRequest is the body of a POST /denylist request.
+type DenyRequest struct {
+	// Prefix is an IP or a CIDR prefix
+	Prefix string `json:"prefix"`
+}
+
+// DeniedPrefixResponse describes a prefix of the denylist.
+type DeniedPrefixResponse struct {
+	Prefix string `json:"prefix"`
+	// Source is "file" for prefixes read from the denylist file and "manual" for the ones added through the API
+	Source string `json:"source"`
+}
+
+// StatsResponse summarizes the state of the firewall.
+type StatsResponse struct {
+	BannedIPs int `json:"banned_ips"`
+	// Metrics are the values of the application Prometheus metrics, without the common prefix
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// TalkerResponse describes an IP that sent SYN packets during the last detection period.
+type TalkerResponse struct {
+	IP    string `json:"ip"`
+	VLAN  uint16 `json:"vlan,omitempty"`
+	SYNs  uint64 `json:"syns"`
+	Ports int    `json:"ports"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler serves the admin API:
+// * GET /bans lists the blocked IPs
+// * POST /bans blocks an IP
+// * DELETE /bans/{ip} unblocks an IP and forgets its offences
+// * GET /denylist lists the denied prefixes
+// * POST /denylist denies a prefix until it is removed or the daemon restarts
+// * DELETE /denylist/{prefix} removes a prefix added through the API
+// * GET /stats summarizes the state of the firewall
+// * GET /top-talkers?limit=n lists the IPs that sent the most SYN packets during the last detection period
+// Requests must carry the token in an "Authorization: Bearer <token>" header. An empty token disables authentication,
+// which is only suitable when the transport is already protected, like a Unix socket.
+type Handler struct {
+	blocklist  *watchers.Blocklist
+	denylist   *watchers.Denylist
+	topTalkers *watchers.TopTalkers
+	events     *watchers.EventLogger
+	token      string
+}
+
+func NewHandler(blocklist *watchers.Blocklist, denylist *watchers.Denylist, topTalkers *watchers.TopTalkers,
+	events *watchers.EventLogger, token string) *Handler {
+	return &Handler{
+		blocklist:  blocklist,
+		denylist:   denylist,
+		topTalkers: topTalkers,
+		events:     events,
+		token:      token,
+	}
+}
+
+// Register adds the admin API routes to the mux.
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.Handle(bansPath, h)
+	mux.Handle(bansPath+"/", h)
+	mux.Handle(denylistPath, h)
+	mux.Handle(denylistPath+"/", h)
+	mux.Handle(statsPath, h)
+	mux.Handle(topTalkersPath, h)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authenticate(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+		return
+	}
+
+	switch {
+	case r.URL.Path == bansPath && r.Method == http.MethodGet:
+		h.listBans(w)
+	case r.URL.Path == bansPath && r.Method == http.MethodPost:
+		h.addBan(w, r)
+	case strings.HasPrefix(r.URL.Path, bansPath+"/") && r.Method == http.MethodDelete:
+		h.removeBan(w, strings.TrimPrefix(r.URL.Path, bansPath+"/"))
+	case r.URL.Path == denylistPath && r.Method == http.MethodGet:
+		h.listDenied(w)
+	case r.URL.Path == denylistPath && r.Method == http.MethodPost:
+		h.deny(w, r)
+	case strings.HasPrefix(r.URL.Path, denylistPath+"/") && r.Method == http.MethodDelete:
+		h.removeDenied(w, strings.TrimPrefix(r.URL.Path, denylistPath+"/"))
+	case r.URL.Path == statsPath && r.Method == http.MethodGet:
+		h.stats(w)
+	case r.URL.Path == topTalkersPath && r.Method == http.MethodGet:
+		h.listTopTalkers(w, r)
+	case r.URL.Path == bansPath || strings.HasPrefix(r.URL.Path, bansPath+"/"),
+		r.URL.Path == denylistPath || strings.HasPrefix(r.URL.Path, denylistPath+"/"),
+		r.URL.Path == statsPath, r.URL.Path == topTalkersPath:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate checks the bearer token of the request in constant time.
+func (h *Handler) authenticate(r *http.Request) bool {
+	if h.token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+func (h *Handler) listBans(w http.ResponseWriter) {
+	bans, err := h.blocklist.List()
+	if err != nil {
+		log.Printf("Error listing bans: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := make([]*BanResponse, 0, len(bans))
+	for _, ban := range bans {
+		response = append(response, newBanResponse(ban))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) addBan(w http.ResponseWriter, r *http.Request) {
+	var request BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	ip, duration, reason, err := parseBanRequest(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ban, err := h.blocklist.Block(ip, duration, reason, time.Now())
+	if err != nil {
+		log.Printf("Error blocking an IP: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.events.LogManualBan(ban)
+	writeJSON(w, http.StatusCreated, newBanResponse(ban))
+}
+
+func (h *Handler) removeBan(w http.ResponseWriter, rawIP string) {
+	ip, err := netaddr.ParseIP(rawIP)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// IPv4-mapped IPv6 addresses are stored as IPv4 addresses
+	ip = ip.Unmap()
+
+	err = h.blocklist.Pardon(ip)
+	if errors.Is(err, watchers.ErrNotBlocked) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error unblocking an IP: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	h.events.LogManualUnban(ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) listDenied(w http.ResponseWriter) {
+	denied := h.denylist.List()
+	response := make([]*DeniedPrefixResponse, 0, len(denied))
+	for _, entry := range denied {
+		response = append(response, &DeniedPrefixResponse{
+			Prefix: entry.Prefix.String(),
+			Source: entry.Source,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handler) deny(w http.ResponseWriter, r *http.Request) {
+	var request DenyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	prefix, err := iplist.ParsePrefix(request.Prefix)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.denylist.Deny(prefix); err != nil {
+		log.Printf("Error denying a prefix: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Prefix %s added to the denylist", prefix)
+	writeJSON(w, http.StatusCreated, &DeniedPrefixResponse{
+		Prefix: prefix.String(),
+		Source: watchers.DenySourceManual,
+	})
+}
+
+func (h *Handler) removeDenied(w http.ResponseWriter, rawPrefix string) {
+	prefix, err := iplist.ParsePrefix(rawPrefix)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = h.denylist.Remove(prefix)
+	switch {
+	case errors.Is(err, watchers.ErrNotDenied):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, watchers.ErrDeniedByFile):
+		writeError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		log.Printf("Error removing a prefix from the denylist: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Prefix %s removed from the denylist", prefix)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) stats(w http.ResponseWriter) {
+	bans, err := h.blocklist.List()
+	if err != nil {
+		log.Printf("Error listing bans: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	metrics, err := gatherMetrics(prometheus.DefaultGatherer)
+	if err != nil {
+		log.Printf("Error gathering metrics: %v", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &StatsResponse{
+		BannedIPs: len(bans),
+		Metrics:   metrics,
+	})
+}
+
+func (h *Handler) listTopTalkers(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", rawLimit))
+			return
+		}
+	}
+	talkers := h.topTalkers.List(limit)
+	response := make([]*TalkerResponse, 0, len(talkers))
+	for _, talker := range talkers {
+		response = append(response, &TalkerResponse{
+			IP:    talker.IP.String(),
+			VLAN:  talker.VLANID,
+			SYNs:  talker.SYNs,
+			Ports: talker.Ports,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// gatherMetrics returns the value of the application counters and gauges, indexed by name without the common prefix.
+func gatherMetrics(gatherer prometheus.Gatherer) (map[string]float64, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]float64)
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), metricsPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(family.GetName(), metricsPrefix)
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.GetCounter() != nil:
+				metrics[name] += metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				metrics[name] += metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// parseBanRequest validates a ban request and applies the defaults.
+func parseBanRequest(request *BanRequest) (netaddr.IP, time.Duration, string, error) {
+	ip, err := netaddr.ParseIP(request.IP)
+	if err != nil {
+		return netaddr.IP{}, 0, "", err
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		duration, err = time.ParseDuration(request.Duration)
+		if err != nil {
+			return netaddr.IP{}, 0, "", err
+		}
+		if duration < 0 {
+			return netaddr.IP{}, 0, "", fmt.Errorf("negative duration %s", duration)
+		}
+	}
+	reason := request.Reason
+	if reason == "" {
+		reason = defaultReason
+	}
+	// IPv4-mapped IPv6 addresses are stored as IPv4 addresses
+	return ip.Unmap(), duration, reason, nil
+}
+
+func newBanResponse(ban *watchers.Ban) *BanResponse {
+	response := &BanResponse{
+		IP:        ban.IP.String(),
+		BlockTime: ban.BlockTime.UTC(),
+		Duration:  "permanent",
+		Reason:    ban.Reason,
+	}
+	if ban.Duration != 0 {
+		expiresAt := ban.BlockTime.Add(ban.Duration).UTC()
+		response.Duration = ban.Duration.String()
+		response.ExpiresAt = &expiresAt
+	}
+	return response
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing admin API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
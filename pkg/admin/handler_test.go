@@ -0,0 +1,184 @@
+package admin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/hugoshaka/teleport-challenge/pkg/watchers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+func TestParseBanRequest(t *testing.T) {
+	testCases := []struct {
+		name             string
+		request          BanRequest
+		expectedIP       netaddr.IP
+		expectedDuration time.Duration
+		expectedReason   string
+		expectedError    bool
+	}{
+		{
+			"Defaults",
+			BanRequest{IP: "192.0.2.1"},
+			netaddr.IPv4(192, 0, 2, 1),
+			0,
+			"manual",
+			false,
+		},
+		{
+			"DurationAndReason",
+			BanRequest{IP: "2001:db8::1", Duration: "1h", Reason: "abuse report"},
+			netaddr.MustParseIP("2001:db8::1"),
+			time.Hour,
+			"abuse report",
+			false,
+		},
+		{
+			"IPv4Mapped",
+			BanRequest{IP: "::ffff:192.0.2.1"},
+			netaddr.IPv4(192, 0, 2, 1),
+			0,
+			"manual",
+			false,
+		},
+		{
+			"InvalidIP",
+			BanRequest{IP: "192.0.2"},
+			netaddr.IP{},
+			0,
+			"",
+			true,
+		},
+		{
+			"NegativeDuration",
+			BanRequest{IP: "192.0.2.1", Duration: "-1h"},
+			netaddr.IP{},
+			0,
+			"",
+			true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ip, duration, reason, err := parseBanRequest(&tc.request)
+
+			assert.Equal(t, tc.expectedError, err != nil)
+			assert.Equal(t, tc.expectedIP, ip)
+			assert.Equal(t, tc.expectedDuration, duration)
+			assert.Equal(t, tc.expectedReason, reason)
+		})
+
+	}
+}
+
+func TestHandlerAuthentication(t *testing.T) {
+	testCases := []struct {
+		name          string
+		authorization string
+	}{
+		{"MissingToken", ""},
+		{"InvalidToken", "Bearer nope"},
+		{"NotBearer", "Basic c2VjcmV0"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewHandler(nil, nil, nil, nil, "secret")
+			request := httptest.NewRequest(http.MethodGet, "/bans", nil)
+			if tc.authorization != "" {
+				request.Header.Set("Authorization", tc.authorization)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		})
+
+	}
+}
+
+func TestHandlerInvalidPrefix(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"InvalidBody", http.MethodPost, "/denylist", "{"},
+		{"InvalidPrefix", http.MethodPost, "/denylist", `{"prefix": "192.0.2.0/33"}`},
+		{"EmptyPrefix", http.MethodPost, "/denylist", `{}`},
+		{"InvalidPrefixInPath", http.MethodDelete, "/denylist/nope", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewHandler(nil, nil, nil, nil, "")
+			request := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		})
+
+	}
+}
+
+func TestHandlerRemoveBan(t *testing.T) {
+	testCases := []struct {
+		name             string
+		path             string
+		expectedCode     int
+		expectedOffences int
+	}{
+		{"IPv4", "/bans/192.0.2.1", http.StatusNoContent, 0},
+		{"IPv4Mapped", "/bans/::ffff:192.0.2.1", http.StatusNoContent, 0},
+		{"NotBlocked", "/bans/192.0.2.2", http.StatusNotFound, 1},
+		{"InvalidIP", "/bans/192.0.2", http.StatusBadRequest, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := rlimit.RemoveMemlock(); err != nil {
+				t.Skipf("Removing the memlock limit: %v", err)
+			}
+			blockingMap, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: 8, MaxEntries: 16})
+			if err != nil {
+				t.Skipf("Creating a BPF map: %v", err)
+			}
+			defer blockingMap.Close()
+			// ban_info_map values are a duration and a 64 bytes reason
+			infoMap, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: 72, MaxEntries: 16})
+			if err != nil {
+				t.Skipf("Creating a BPF map: %v", err)
+			}
+			defer infoMap.Close()
+			ip := netaddr.IPv4(192, 0, 2, 1)
+			now := time.Now()
+			policy := watchers.NewBanPolicy([]time.Duration{time.Hour, 24 * time.Hour}, time.Hour)
+			blocklist := watchers.NewBlocklist(blockingMap, infoMap, policy)
+			_, duration := policy.Offend(ip, now)
+			_, err = blocklist.Block(ip, duration, "port scan", now)
+			require.NoError(t, err)
+			events, err := watchers.NewEventLogger(watchers.LogFormatJSON, io.Discard)
+			require.NoError(t, err)
+			handler := NewHandler(blocklist, nil, nil, events, "")
+			request := httptest.NewRequest(http.MethodDelete, tc.path, nil)
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			assert.Equal(t, tc.expectedCode, recorder.Code)
+			// A pardoned IP gets the shortest ban if it offends again
+			count, _ := policy.NextOffence(ip, now)
+			assert.Equal(t, tc.expectedOffences+1, count)
+		})
+
+	}
+}
@@ -0,0 +1,87 @@
+// Package iplist parses lists of IP addresses and CIDR prefixes such as allowlists.
+package iplist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// ParsePrefix parses a CIDR prefix. A bare IP address is considered as a single-address prefix.
+func ParsePrefix(raw string) (netaddr.IPPrefix, error) {
+	if !strings.Contains(raw, "/") {
+		ip, err := netaddr.ParseIP(raw)
+		if err != nil {
+			return netaddr.IPPrefix{}, err
+		}
+		return netaddr.IPPrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netaddr.ParseIPPrefix(raw)
+	if err != nil {
+		return netaddr.IPPrefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// Parse parses a list of IPs or CIDR prefixes, empty entries are ignored.
+func Parse(entries []string) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Read parses a list of IPs or CIDR prefixes, one per line. Blank lines and comments starting with '#' are ignored.
+func Read(r io.Reader) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := scanner.Text()
+		if i := strings.Index(entry, "#"); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// ReadFile parses a file containing IPs or CIDR prefixes, see Read for the format.
+func ReadFile(path string) ([]netaddr.IPPrefix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	prefixes, err := Read(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,61 @@
+package iplist
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestParsePrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		raw      string
+		expected netaddr.IPPrefix
+	}{
+		{
+			"BareIPv4",
+			"192.0.2.1",
+			netaddr.MustParseIPPrefix("192.0.2.1/32"),
+		},
+		{
+			"CIDR",
+			"10.0.0.0/8",
+			netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		},
+		{
+			"UnmaskedCIDR",
+			"10.1.2.3/16",
+			netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ParsePrefix(tc.raw)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+
+	}
+}
+
+func TestRead(t *testing.T) {
+	input := `# monitoring probes
+192.0.2.1
+  10.0.0.0/8   # internal scanner
+
+`
+	result, err := Read(strings.NewReader(input))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("192.0.2.1/32"),
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	}, result)
+
+	_, err = Read(strings.NewReader("192.0.2.1\nnot-an-ip\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
@@ -0,0 +1,148 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"inet.af/netaddr"
+)
+
+// localAddressWatcher follows the addresses assigned to the interfaces through rtnetlink and keeps local_ip_map up to
+// date, so the XDP program only records the UDP datagrams addressed to the host.
+type localAddressWatcher struct {
+	localMap *ebpf.Map
+	// links are the indexes of the interfaces each local address is assigned to, an address can be assigned to
+	// several interfaces and stays local until it is removed from all of them
+	links  map[netaddr.IP]map[int]bool
+	listFn func() ([]addressEvent, error)
+}
+
+// NewLocalAddressWatcher creates a watcher writing the addresses of the host in the local IP map.
+func NewLocalAddressWatcher(localMap *ebpf.Map) Watcher {
+	return &localAddressWatcher{
+		localMap: localMap,
+		links:    make(map[netaddr.IP]map[int]bool),
+		listFn:   listAddresses,
+	}
+}
+
+// Run handles address notifications until the context is cancelled, or if we face an error. As for the interface
+// watcher, the subscription stops when notifications are lost, we then subscribe again and list the addresses.
+func (w *localAddressWatcher) Run(ctx context.Context) error {
+	for {
+		done := make(chan struct{})
+		updates := make(chan netlink.AddrUpdate, addrUpdatesBuffer)
+		err := netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+			ErrorCallback: func(err error) {
+				// Closing the subscription on shutdown makes the pending read fail
+				if ctx.Err() == nil {
+					log.Printf("Error reading netlink notifications: %v", err)
+				}
+			},
+		})
+		if err != nil {
+			close(done)
+			return fmt.Errorf("subscribing to netlink notifications: %w", err)
+		}
+
+		// Addresses might have changed before the subscription, or while notifications were lost
+		if err := w.resync(); err != nil {
+			close(done)
+			return err
+		}
+		err = w.handleUpdates(ctx, updates)
+		close(done)
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			log.Println("Stopping local address watcher")
+			return nil
+		}
+		log.Println("Netlink subscription lost, subscribing again and listing addresses")
+	}
+}
+
+// handleUpdates handles address notifications until the subscription stops or the context is cancelled.
+func (w *localAddressWatcher) handleUpdates(ctx context.Context, updates <-chan netlink.AddrUpdate) error {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			event, ok := newAddressEvent(update)
+			if !ok {
+				continue
+			}
+			if err := w.handle(event); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// resync compares the local addresses with the existing ones, as if a notification was received for each of them.
+func (w *localAddressWatcher) resync() error {
+	events, err := w.listFn()
+	if err != nil {
+		return fmt.Errorf("listing addresses: %w", err)
+	}
+	existing := make(map[netaddr.IP]map[int]bool)
+	for _, event := range events {
+		if existing[event.ip] == nil {
+			existing[event.ip] = make(map[int]bool)
+		}
+		existing[event.ip][event.index] = true
+		if err := w.handle(event); err != nil {
+			return err
+		}
+	}
+	for ip, links := range w.links {
+		for index := range links {
+			if !existing[ip][index] {
+				if err := w.handle(addressEvent{ip: ip, index: index, deleted: true}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// handle adds a new address to the local IP map, and removes an address once it is not assigned to any interface.
+func (w *localAddressWatcher) handle(event addressEvent) error {
+	links := w.links[event.ip]
+	if !event.deleted {
+		if links == nil {
+			if err := w.localMap.Put(marshalIP(event.ip), uint8(1)); err != nil {
+				return fmt.Errorf("adding %s to local_ip_map: %w", event.ip, err)
+			}
+			links = make(map[int]bool)
+			w.links[event.ip] = links
+		}
+		links[event.index] = true
+		return nil
+	}
+
+	if !links[event.index] {
+		return nil
+	}
+	delete(links, event.index)
+	if len(links) > 0 {
+		return nil
+	}
+	delete(w.links, event.ip)
+	if err := w.localMap.Delete(marshalIP(event.ip)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("removing %s from local_ip_map: %w", event.ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package watchers
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+// localIPs lists the IPs of the local IP map.
+func localIPs(t *testing.T, localMap *ebpf.Map) []netaddr.IP {
+	var ips []netaddr.IP
+	var key [16]byte
+	var value uint8
+	entries := localMap.Iterate()
+	for entries.Next(&key, &value) {
+		ips = append(ips, unmarshalIP(key))
+	}
+	require.NoError(t, entries.Err())
+	sortIPs(ips)
+	return ips
+}
+
+func TestLocalAddressWatcherHandle(t *testing.T) {
+	ip := netaddr.MustParseIP("192.0.2.1")
+	otherIP := netaddr.MustParseIP("2001:db8::1")
+	testCases := []struct {
+		name     string
+		events   []addressEvent
+		expected []netaddr.IP
+	}{
+		{
+			"NewAddress",
+			[]addressEvent{{ip: otherIP, index: 3}},
+			[]netaddr.IP{ip, otherIP},
+		},
+		{
+			"Removed",
+			[]addressEvent{{ip: ip, index: 2, deleted: true}},
+			nil,
+		},
+		{
+			"RemovedFromOtherInterface",
+			[]addressEvent{{ip: ip, index: 3, deleted: true}},
+			[]netaddr.IP{ip},
+		},
+		{
+			"StillAssigned",
+			[]addressEvent{{ip: ip, index: 3}, {ip: ip, index: 2, deleted: true}},
+			[]netaddr.IP{ip},
+		},
+		{
+			"RemovedFromAll",
+			[]addressEvent{{ip: ip, index: 3}, {ip: ip, index: 2, deleted: true}, {ip: ip, index: 3, deleted: true}},
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			localMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.Hash, KeySize: 16, ValueSize: 1, MaxEntries: 16})
+			w := NewLocalAddressWatcher(localMap).(*localAddressWatcher)
+			require.NoError(t, w.handle(addressEvent{ip: ip, index: 2}))
+
+			for _, event := range tc.events {
+				require.NoError(t, w.handle(event))
+			}
+			assert.Equal(t, tc.expected, localIPs(t, localMap))
+		})
+	}
+}
+
+func TestLocalAddressWatcherResync(t *testing.T) {
+	localMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.Hash, KeySize: 16, ValueSize: 1, MaxEntries: 16})
+	w := NewLocalAddressWatcher(localMap).(*localAddressWatcher)
+	w.listFn = func() ([]addressEvent, error) {
+		return []addressEvent{
+			{ip: netaddr.MustParseIP("192.0.2.1"), index: 2},
+			{ip: netaddr.MustParseIP("::1"), index: 1},
+		}, nil
+	}
+	require.NoError(t, w.resync())
+	assert.Equal(t, []netaddr.IP{netaddr.MustParseIP("192.0.2.1"), netaddr.MustParseIP("::1")}, localIPs(t, localMap))
+
+	// The address moved to another interface while notifications were lost
+	w.listFn = func() ([]addressEvent, error) {
+		return []addressEvent{{ip: netaddr.MustParseIP("192.0.2.1"), index: 4}}, nil
+	}
+	require.NoError(t, w.resync())
+	assert.Equal(t, []netaddr.IP{netaddr.MustParseIP("192.0.2.1")}, localIPs(t, localMap))
+	assert.Equal(t, map[netaddr.IP]map[int]bool{netaddr.MustParseIP("192.0.2.1"): {4: true}}, w.links)
+}
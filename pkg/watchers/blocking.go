@@ -2,41 +2,172 @@ package watchers
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log"
+	"os"
 	"time"
 
 	"github.com/cilium/ebpf"
+	"github.com/hugoshaka/teleport-challenge/bpf"
 	"inet.af/netaddr"
 )
 
 var (
-	scansDetected = promauto.NewCounter(prometheus.CounterOpts{
+	scansDetected = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "teleportchallenge_scans_detected_total",
-		Help: "The number of port scans detected since the start of the application.",
+		Help: "The number of port scans detected since the start of the application, per protocol.",
+	}, []string{"protocol"})
+	scansBlockedInKernel = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "teleportchallenge_scans_blocked_in_kernel_total",
+		Help: "The number of port scans the XDP program blocked by itself, on the packet crossing the threshold.",
+	})
+	sweepsDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "teleportchallenge_sweeps_detected_total",
+		Help: "The number of horizontal scans, probing many destination IPs, detected since the start of the application.",
+	})
+	slowScansDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "teleportchallenge_slow_scans_detected_total",
+		Help: "The number of port scans spread over 24 hours detected since the start of the application.",
+	})
+	floodsDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "teleportchallenge_syn_floods_detected_total",
+		Help: "The number of IPs caught sending SYNs faster than the flood threshold since the start of the application.",
 	})
 )
 
-// blockingWatcher reads the BPF metricMap and blocks IPs doing port scan via the blockingMap.
+// ephemeralPortsPath is the procfs file holding the local port range, it applies to IPv6 too.
+const ephemeralPortsPath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// sweepBatchSize is the number of sweep_map entries read or deleted per syscall.
+const sweepBatchSize = 4096
+
+// kernelConfig is the configuration of the in-kernel port scan detection, see config in types.h.
+type kernelConfig struct {
+	Window       uint64
+	BootTime     uint64
+	Threshold    uint32
+	Enabled      uint8
+	UDPEnabled   uint8
+	SweepEnabled uint8
+	_            [1]byte
+	SYNRate      uint32
+	SYNBurst     uint32
+	// EphemeralPorts is the local port range of the outgoing connections
+	EphemeralPorts [2]uint16
+	_              [4]byte
+}
+
+// BlockingOptions configures how the blockingWatcher detects port scans and blocks IPs.
+type BlockingOptions struct {
+	// Window is the length of the sliding window port scans are detected in
+	Window time.Duration
+	// Interval is the time between two evaluations of the sliding window
+	Interval time.Duration
+	// Threshold is the number of ports an IP can connect to within any Window without being blocked
+	Threshold int
+	// UDPThreshold is the number of UDP ports an IP can send datagrams to within any Window without being blocked, 0
+	// disables UDP scan detection
+	UDPThreshold int
+	// SweepThreshold is the number of destination IPs an IP can probe within any Window without being blocked, 0
+	// disables sweep detection
+	SweepThreshold int
+	// SlowScanThreshold is the number of distinct TCP and UDP ports an IP can contact over 24 hours without being
+	// blocked, 0 disables slow scan detection
+	SlowScanThreshold int
+	// VLANThresholds overrides Threshold for IPs seen on specific VLANs
+	VLANThresholds map[uint16]int
+	// Policy decides for how long IPs are blocked, repeat offenders get longer bans
+	Policy *BanPolicy
+	// Allowlist contains the IPs that are never blocked
+	Allowlist *netaddr.IPSet
+	// Events outputs the ban decisions
+	Events *EventLogger
+	// DryRun makes the watcher log the IPs it would block without blocking them
+	DryRun bool
+	// TopTalkers receives the IPs seen during each Window, it can be nil
+	TopTalkers *TopTalkers
+	// SlowScans keeps the distinct ports of the IPs over 24 hours when SlowScanThreshold is set, so the snapshot
+	// watcher can save it. A new one is created if it is nil.
+	SlowScans *SlowScanTracker
+	// KernelBans receives the IPs the XDP program blocked by itself, the watcher records their bans
+	KernelBans <-chan netaddr.IP
+	// SYNRate is the number of SYNs per second the XDP program lets through for each IP, 0 disables rate limiting
+	SYNRate uint32
+	// SYNBurst is the number of SYNs an IP can send at once before being rate limited
+	SYNBurst uint32
+	// FloodThreshold is the number of SYNs per second an IP can send during an Interval without being blocked, 0
+	// disables SYN flood detection
+	FloodThreshold float64
+}
+
+// blockingWatcher reads the BPF metricMap and blocks IPs doing port scan via the Blocklist, as well as the IPs probing
+// many hosts found in the sweepMap. It also configures the XDP program so it blocks the IPs crossing the threshold by
+// itself, without waiting for the next evaluation, and records the bans the XDP program issued.
 type blockingWatcher struct {
-	blockingMap *ebpf.Map
-	metricMap   *ebpf.Map
-	period      time.Duration
-	threshold   int
+	blocklist        *Blocklist
+	metricMap        *ebpf.Map
+	configMap        *ebpf.Map
+	vlanThresholdMap *ebpf.Map
+	sweepMap         *ebpf.Map
+	options          BlockingOptions
+	interfaces       *interfaceNames
+	// synBaseline holds the SYN counters of the IPs when the top talkers were last updated, the counters of the BPF
+	// map are never reset
+	synBaseline map[netaddr.IP]uint64
+	talkersTime time.Time
+	// previousSYNs holds the SYN counters of the IPs at the previous evaluation, to compute their SYN rate
+	previousSYNs map[netaddr.IP]uint64
+	previousTime time.Time
+	// ephemeralPorts is the local port range, the XDP program does not take ACKs and datagrams to these ports for ACK
+	// scan probes and new UDP flows
+	ephemeralPorts [2]uint16
+	// startTime is when the watcher started, the bans the XDP program issued since then are recorded
+	startTime time.Time
+	// slowScans keeps the distinct ports of the IPs over 24 hours, the metricMap forgets them after a Window. It is
+	// nil if slow scan detection is disabled.
+	slowScans *SlowScanTracker
 }
 
-func NewBlockingWatcher(metricMap, blockingMap *ebpf.Map, period time.Duration, threshold int) Watcher {
-	return &blockingWatcher{
-		blockingMap: blockingMap,
-		metricMap:   metricMap,
-		period:      period,
-		threshold:   threshold,
+// NewBlockingWatcher creates a blocking watcher reading and configuring the XDP program through its maps. It also
+// exposes the amount of SYNs dropped by the rate limiting, as read from the SYNDropped map.
+func NewBlockingWatcher(maps *bpf.Maps, blocklist *Blocklist, options BlockingOptions) Watcher {
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "teleportchallenge_syns_rate_limited_total",
+		Help: "The amount of SYNs the XDP program dropped because their source IP exceeded the SYN rate.",
+	}, func() float64 {
+		return sumPerCPUCounter(maps.SYNDropped, "syn_dropped_map")
+	}))
+	w := &blockingWatcher{
+		blocklist:        blocklist,
+		metricMap:        maps.Metric,
+		configMap:        maps.Config,
+		vlanThresholdMap: maps.VLANThresholds,
+		sweepMap:         maps.Sweep,
+		options:          options,
+		interfaces:       interfaceCache,
+		synBaseline:      make(map[netaddr.IP]uint64),
+		talkersTime:      time.Now(),
 	}
+	if options.SlowScanThreshold > 0 {
+		w.slowScans = options.SlowScans
+		if w.slowScans == nil {
+			w.slowScans = NewSlowScanTracker()
+		}
+	}
+	return w
 }
 
 func (w *blockingWatcher) Run(ctx context.Context) error {
-	ticker := time.NewTicker(w.period)
+	// Block times are stored in seconds
+	w.startTime = time.Unix(time.Now().Unix(), 0)
+	if err := w.configureKernel(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(w.options.Interval)
 
 	for {
 		select {
@@ -45,6 +176,22 @@ func (w *blockingWatcher) Run(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
+			if err := w.searchSweeps(); err != nil {
+				return err
+			}
+			if err := w.reconcileKernelBans(); err != nil {
+				return err
+			}
+			// The wall clock might have been adjusted, the boot time is refreshed so block times stay accurate
+			if err := w.writeKernelConfig(); err != nil {
+				return err
+			}
+
+		case ip := <-w.options.KernelBans:
+			err := w.recordKernelBan(ip)
+			if err != nil {
+				return err
+			}
 
 		case <-ctx.Done():
 			log.Println("Stopping blocking watcher")
@@ -53,34 +200,131 @@ func (w *blockingWatcher) Run(ctx context.Context) error {
 	}
 }
 
-// searchInfringingIPs consumes entirely the metricMap searching for source IPs that connected to too many
-// ports since the last tick. Infringing IPs are then added to the block list.
+// searchInfringingIPs reads the metricMap searching for source IPs that connected to too many TCP or UDP ports within
+// the sliding window. Infringing IPs are then added to the block list and removed from the metricMap, as well as the
+// IPs that stayed quiet for the whole window.
+// Every call reads the whole metricMap with one syscall per IP, each value holding a metric per CPU: with the map
+// full (65536 IPs) it copies about 14MB per CPU, which bounds how low the detection interval can reasonably go.
 func (w *blockingWatcher) searchInfringingIPs() error {
-	var key [4]byte
+	var key [16]byte
 	var value [][]byte
 	var ip netaddr.IP
 
+	windowStart, err := w.windowStart()
+	if err != nil {
+		return err
+	}
+
+	// The top talkers are updated once per window, with the SYNs received since the last update
+	var talkers []Talker
+	updateTalkers := time.Since(w.talkersTime) >= w.options.Window
+	synBaseline := make(map[netaddr.IP]uint64)
+	// SYN rates are computed over the time elapsed since the previous evaluation. The counters are unknown at the
+	// first one, they might have been accumulated by a previous run in a pinned map.
+	now := time.Now()
+	elapsed := now.Sub(w.previousTime).Seconds()
+	checkFloods := w.options.FloodThreshold > 0 && !w.previousTime.IsZero() && elapsed > 0
+	previousSYNs := make(map[netaddr.IP]uint64)
+
 	// Iterate over every IP
 	values := w.metricMap.Iterate()
 	for values.Next(&key, &value) {
-		err := w.metricMap.Delete(key)
-		if err != nil {
-			return err
-		}
-		ip = netaddr.IPFrom4(key)
+		ip = unmarshalIP(key)
 		metrics := make([]*ipMetric, 0, len(value))
 
 		// Iterate over every CPU
 		for _, cpuValue := range value {
-			cpuMetric, _ := unmarshalIPMetric(cpuValue)
+			cpuMetric, err := unmarshalIPMetric(cpuValue)
+			if err != nil {
+				return err
+			}
 			metrics = append(metrics, cpuMetric)
 		}
 
 		// Consolidate metrics from all CPUs into a single struct
 		metric := mergeIPMetric(metrics)
-		if len(metric.ports) > w.threshold {
-			err := w.blockIP(ip, metric)
-			if err != nil {
+		w.resolveInterface(metric)
+		ports := metric.portsSince(windowStart)
+		udpPorts := metric.udpPortsSince(windowStart)
+		var distinctPorts int
+		if w.slowScans != nil && len(ports)+len(udpPorts) > 0 {
+			distinctPorts = w.slowScans.add(ip, ports, udpPorts, now)
+		}
+		if updateTalkers {
+			talkers = append(talkers, Talker{
+				IP:     ip,
+				VLANID: metric.vlanID,
+				SYNs:   w.synsSinceBaseline(ip, metric.synReceived),
+				Ports:  len(ports),
+			})
+		}
+
+		// Every IP is seeded, including the ones skipped below, otherwise their next rate would be computed from their
+		// whole counter
+		previousSYNs[ip] = metric.synReceived
+		// removeIP is set when the IP is removed from the metricMap
+		removeIP := false
+
+		switch {
+		case checkFloods && w.synRate(ip, metric.synReceived, elapsed) > w.options.FloodThreshold:
+			if blocked, err := w.blocklist.isBlocked(ip); err != nil || blocked {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			// Allowlisted IPs are expected to be busy, they are not reported
+			if !w.options.Allowlist.Contains(ip) {
+				err := w.blockFlood(ip, metric, w.synRate(ip, metric.synReceived, elapsed))
+				if err != nil {
+					return err
+				}
+			}
+			removeIP = true
+		case len(ports) == 0 && len(udpPorts) == 0:
+			// The IP stayed quiet for the whole window
+			removeIP = true
+		case len(ports) > w.threshold(metric.vlanID):
+			// The XDP program blocked the IP by itself, the tracking watcher will hand the ban over
+			if blocked, err := w.blocklist.isBlocked(ip); err != nil || blocked {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.blockScan(ip, metric, protocolTCP, ports); err != nil {
+				return err
+			}
+			// The observations are dropped so the IP is not caught again for the same ports
+			removeIP = true
+		case w.options.UDPThreshold > 0 && len(udpPorts) > w.options.UDPThreshold:
+			// UDP scans are only caught here, the XDP program does not block them by itself
+			if err := w.blockScan(ip, metric, protocolUDP, udpPorts); err != nil {
+				return err
+			}
+			removeIP = true
+		case w.slowScans != nil && distinctPorts > w.options.SlowScanThreshold:
+			if blocked, err := w.blocklist.isBlocked(ip); err != nil || blocked {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if w.options.Allowlist.Contains(ip) {
+				w.options.Events.logBanSkipped(ip, metric, "allowlisted")
+			} else if err := w.blockSlowScan(ip, metric, distinctPorts); err != nil {
+				return err
+			}
+			// The history is dropped so the IP is not caught again for the same ports
+			w.slowScans.forget(ip)
+			removeIP = true
+		default:
+			synBaseline[ip] = metric.synReceived
+		}
+		if removeIP {
+			// The XDP program starts the counter over when the IP comes back
+			delete(previousSYNs, ip)
+			if err := w.metricMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
 				return err
 			}
 		}
@@ -90,30 +334,374 @@ func (w *blockingWatcher) searchInfringingIPs() error {
 		log.Printf("Error reading ip_metic_map: %s", err)
 		return err
 	}
+	w.previousSYNs = previousSYNs
+	w.previousTime = now
+	if updateTalkers {
+		w.synBaseline = synBaseline
+		w.talkersTime = time.Now()
+		if w.options.TopTalkers != nil {
+			w.options.TopTalkers.update(talkers)
+		}
+	}
 	return nil
 }
 
-// blockIP adds an IP to the blocking map.
-func (w *blockingWatcher) blockIP(ip netaddr.IP, metric *ipMetric) error {
-	ports := make([]uint16, len(metric.ports))
+// searchSweeps reads the sweepMap searching for source IPs that probed too many destination IPs within the sliding
+// window. Infringing IPs are then added to the block list and their entries removed from the sweepMap, as well as the
+// entries older than the window. Without sweep detection the map is left to its LRU.
+func (w *blockingWatcher) searchSweeps() error {
+	if w.options.SweepThreshold == 0 {
+		return nil
+	}
+	windowStart, err := w.windowStart()
+	if err != nil {
+		return err
+	}
 
-	// Create a slice with all the ports
-	i := 0
-	for k := range metric.ports {
-		ports[i] = k
-		i++
+	keys, seen, err := readSweepMap(w.sweepMap)
+	if err != nil {
+		log.Printf("Error reading sweep_map: %s", err)
+		return err
+	}
+	var staleKeys [][32]byte
+	dests := make(map[netaddr.IP][]netaddr.IP)
+	for i, key := range keys {
+		if seen[i] < windowStart {
+			staleKeys = append(staleKeys, key)
+			continue
+		}
+		sourceIP, destIP := unmarshalSweepKey(key)
+		dests[sourceIP] = append(dests[sourceIP], destIP)
 	}
 
-	log.Printf("Port scan detected: %v on ports %v", ip, ports)
-	scansDetected.Inc()
+	for ip, ipDests := range dests {
+		if len(ipDests) <= w.options.SweepThreshold {
+			continue
+		}
+		if blocked, err := w.blocklist.isBlocked(ip); err != nil || blocked {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		sortIPs(ipDests)
+		if w.options.Allowlist.Contains(ip) {
+			w.options.Events.logBanSkipped(ip, &ipMetric{}, "allowlisted")
+		} else if err := w.blockSweep(ip, ipDests); err != nil {
+			return err
+		}
+		// The observations are dropped so the IP is not caught again for the same destinations
+		for _, destIP := range ipDests {
+			staleKeys = append(staleKeys, marshalSweepKey(ip, destIP))
+		}
+	}
+
+	return deleteSweepKeys(w.sweepMap, staleKeys)
+}
+
+// readSweepMap reads all the entries of the sweepMap. The map holds up to 262144 entries, they are read
+// sweepBatchSize at a time on kernels supporting batch operations (Linux 5.6+), and one at a time otherwise.
+func readSweepMap(sweepMap *ebpf.Map) ([][32]byte, []uint64, error) {
+	var keys [][32]byte
+	var seen []uint64
+	batchKeys := make([][32]byte, sweepBatchSize)
+	batchSeen := make([]uint64, sweepBatchSize)
+	// The cursor is opaque, the kernel returns where the next batch starts
+	var cursor interface{}
+	var nextCursor [32]byte
+	for {
+		count, err := sweepMap.BatchLookup(cursor, &nextCursor, batchKeys, batchSeen, nil)
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			return iterateSweepMap(sweepMap)
+		}
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, nil, err
+		}
+		keys = append(keys, batchKeys[:count]...)
+		seen = append(seen, batchSeen[:count]...)
+		// ErrKeyNotExist tells the whole map was read
+		if err != nil {
+			return keys, seen, nil
+		}
+		cursor = nextCursor
+	}
+}
 
-	key := ip.As4()
-	blockTime := uint64(time.Now().Unix())
+// iterateSweepMap reads all the entries of the sweepMap one at a time.
+func iterateSweepMap(sweepMap *ebpf.Map) ([][32]byte, []uint64, error) {
+	var keys [][32]byte
+	var seen []uint64
+	var key [32]byte
+	var keySeen uint64
+	entries := sweepMap.Iterate()
+	for entries.Next(&key, &keySeen) {
+		keys = append(keys, key)
+		seen = append(seen, keySeen)
+	}
+	return keys, seen, entries.Err()
+}
+
+// deleteSweepKeys deletes entries of the sweepMap, in batches if the kernel supports it. Entries evicted in the
+// meantime are skipped.
+func deleteSweepKeys(sweepMap *ebpf.Map, keys [][32]byte) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > sweepBatchSize {
+			batch = batch[:sweepBatchSize]
+		}
+		// The kernel stops at the first missing key, count is the number of keys deleted before it
+		count, err := sweepMap.BatchDelete(batch, nil)
+		switch {
+		case errors.Is(err, ebpf.ErrNotSupported):
+			for _, key := range keys {
+				err := sweepMap.Delete(key)
+				if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+					return err
+				}
+			}
+			return nil
+		case errors.Is(err, ebpf.ErrKeyNotExist):
+			keys = keys[count+1:]
+		case err != nil:
+			return err
+		default:
+			keys = keys[count:]
+		}
+	}
+	return nil
+}
 
-	err := w.blockingMap.Put(key, blockTime)
+// recordKernelBan logs a ban issued by the XDP program and applies the ban policy to it, as if the watcher had
+// blocked the IP itself.
+func (w *blockingWatcher) recordKernelBan(ip netaddr.IP) error {
+	// The ban was already recorded by reconcileKernelBans
+	if w.blocklist.known(ip) {
+		return nil
+	}
+	key := marshalIP(ip)
+	metric := &ipMetric{}
+	var ports []uint16
+
+	var value [][]byte
+	err := w.metricMap.Lookup(key, &value)
+	// The IP might have been evicted by the LRU in the meantime
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	if err == nil {
+		metrics := make([]*ipMetric, 0, len(value))
+		for _, cpuValue := range value {
+			cpuMetric, err := unmarshalIPMetric(cpuValue)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, cpuMetric)
+		}
+		metric = mergeIPMetric(metrics)
+		w.resolveInterface(metric)
+		windowStart, err := w.windowStart()
+		if err != nil {
+			return err
+		}
+		ports = metric.portsSince(windowStart)
+	}
+
+	scansBlockedInKernel.Inc()
+	if err := w.blockIP(ip, metric, protocolTCP, ports); err != nil {
+		return err
+	}
+	err = w.metricMap.Delete(key)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// reconcileKernelBans records the bans the XDP program issued since the watcher started, but that the tracking watcher
+// did not hand over because their connection record was lost when the ring buffer was full.
+func (w *blockingWatcher) reconcileKernelBans() error {
+	bans, err := w.blocklist.unknownBans(w.startTime)
+	if err != nil {
+		log.Printf("Error reading ip_blocked_map: %s", err)
+		return err
+	}
+	for _, ban := range bans {
+		if err := w.recordKernelBan(ban.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureKernel writes the VLAN thresholds and the configuration of the in-kernel port scan detection.
+func (w *blockingWatcher) configureKernel() error {
+	for vlanID, threshold := range w.options.VLANThresholds {
+		// The XDP program reads VLAN IDs from the wire, in network byte order
+		var key [2]byte
+		binary.BigEndian.PutUint16(key[:], vlanID)
+		if err := w.vlanThresholdMap.Put(key, uint32(threshold)); err != nil {
+			return fmt.Errorf("writing VLAN threshold: %w", err)
+		}
+	}
+
+	rawPortRange, err := os.ReadFile(ephemeralPortsPath)
+	if err == nil {
+		w.ephemeralPorts, err = parsePortRange(string(rawPortRange))
+	}
+	if err != nil {
+		log.Printf("Error reading the local port range, using %d-%d: %v", defaultEphemeralPorts[0], defaultEphemeralPorts[1], err)
+		w.ephemeralPorts = defaultEphemeralPorts
+	}
+	return w.writeKernelConfig()
+}
+
+// writeKernelConfig writes the configuration of the in-kernel port scan detection and SYN rate limiting.
+func (w *blockingWatcher) writeKernelConfig() error {
+	now, err := monotonicNow()
+	if err != nil {
+		return fmt.Errorf("reading monotonic clock: %w", err)
+	}
+	config := kernelConfig{
+		Window:         uint64(w.options.Window),
+		BootTime:       uint64(time.Now().UnixNano()) - now,
+		Threshold:      uint32(w.options.Threshold),
+		EphemeralPorts: w.ephemeralPorts,
+	}
+	if w.options.UDPThreshold > 0 {
+		config.UDPEnabled = 1
+	}
+	if w.options.SweepThreshold > 0 {
+		config.SweepEnabled = 1
+	}
+	// Neither blocking nor rate limiting are enforced in dry run mode
+	if !w.options.DryRun {
+		config.Enabled = 1
+		config.SYNRate = w.options.SYNRate
+		config.SYNBurst = w.options.SYNBurst
+	}
+	if err := w.configMap.Put(uint32(0), config); err != nil {
+		return fmt.Errorf("writing config_map: %w", err)
+	}
+	return nil
+}
+
+// windowStart returns the start of the sliding window, in nanoseconds since boot.
+func (w *blockingWatcher) windowStart() (uint64, error) {
+	now, err := monotonicNow()
+	if err != nil {
+		return 0, fmt.Errorf("reading monotonic clock: %w", err)
+	}
+	if window := uint64(w.options.Window); now > window {
+		return now - window, nil
+	}
+	return 0, nil
+}
+
+// resolveInterface sets the name of the interface an IP was last seen on, if the XDP program recorded it.
+func (w *blockingWatcher) resolveInterface(metric *ipMetric) {
+	if metric.ifindex != 0 {
+		metric.iface = w.interfaces.name(metric.ifindex)
+	}
+}
+
+// synsSinceBaseline returns the SYNs an IP sent since the top talkers were last updated. Counters start over when
+// the IP is removed from the metricMap.
+func (w *blockingWatcher) synsSinceBaseline(ip netaddr.IP, synReceived uint64) uint64 {
+	if baseline, ok := w.synBaseline[ip]; ok && baseline <= synReceived {
+		return synReceived - baseline
+	}
+	return synReceived
+}
+
+// blockScan blocks an IP caught scanning the ports of a protocol, unless it is allowlisted.
+func (w *blockingWatcher) blockScan(ip netaddr.IP, metric *ipMetric, protocol string, ports []uint16) error {
+	if w.options.Allowlist.Contains(ip) {
+		w.options.Events.logBanSkipped(ip, metric, "allowlisted")
+		return nil
+	}
+	return w.blockIP(ip, metric, protocol, ports)
+}
+
+// blockIP adds an IP caught scanning the ports of a protocol to the blocking map. In dry run mode the decision is
+// only logged.
+func (w *blockingWatcher) blockIP(ip netaddr.IP, metric *ipMetric, protocol string, ports []uint16) error {
+	reason := reasonPortScan
+	if protocol == protocolUDP {
+		reason = reasonUDPPortScan
+	}
+	return w.ban(ip, reason, func(count int, banDuration time.Duration) {
+		w.options.Events.logBan(ip, metric, protocol, ports, count, banDuration, w.options.DryRun)
+		scansDetected.WithLabelValues(protocol).Inc()
+	})
+}
+
+// blockSweep adds an IP caught probing many destination IPs to the blocking map. In dry run mode the decision is only
+// logged.
+func (w *blockingWatcher) blockSweep(ip netaddr.IP, dests []netaddr.IP) error {
+	return w.ban(ip, reasonSweep, func(count int, banDuration time.Duration) {
+		w.options.Events.logSweep(ip, dests, count, banDuration, w.options.DryRun)
+		sweepsDetected.Inc()
+	})
+}
+
+// blockSlowScan adds an IP caught scanning ports over 24 hours to the blocking map. In dry run mode the decision is
+// only logged.
+func (w *blockingWatcher) blockSlowScan(ip netaddr.IP, metric *ipMetric, distinctPorts int) error {
+	return w.ban(ip, reasonSlowScan, func(count int, banDuration time.Duration) {
+		w.options.Events.logSlowScan(ip, metric, distinctPorts, count, banDuration, w.options.DryRun)
+		slowScansDetected.Inc()
+	})
+}
+
+// blockFlood adds an IP caught flooding SYNs to the blocking map. In dry run mode the decision is only logged.
+func (w *blockingWatcher) blockFlood(ip netaddr.IP, metric *ipMetric, synRate float64) error {
+	return w.ban(ip, reasonSYNFlood, func(count int, banDuration time.Duration) {
+		w.options.Events.logSYNFlood(ip, metric, synRate, count, banDuration, w.options.DryRun)
+		floodsDetected.Inc()
+	})
+}
+
+// ban records the offence of an IP, logs the decision with logBan and blocks the IP unless running in dry run mode.
+func (w *blockingWatcher) ban(ip netaddr.IP, reason string, logBan func(count int, banDuration time.Duration)) error {
+	now := time.Now()
+	// A dry run must not escalate the ban duration of the next offences
+	if w.options.DryRun {
+		logBan(w.options.Policy.NextOffence(ip, now))
+		return nil
+	}
+	count, banDuration := w.options.Policy.Offend(ip, now)
+	logBan(count, banDuration)
+
+	_, err := w.blocklist.Block(ip, banDuration, reason, now)
 	if err != nil {
 		log.Printf("Error blocking an IP: %v", err)
 		return err
 	}
 	return nil
 }
+
+// synRate returns the SYNs per second an IP sent since the previous evaluation. IPs that were not in the metricMap
+// at the previous evaluation, or whose counter started over, sent all their SYNs since then.
+func (w *blockingWatcher) synRate(ip netaddr.IP, synReceived uint64, elapsed float64) float64 {
+	syns := synReceived
+	if previous, ok := w.previousSYNs[ip]; ok && previous <= synReceived {
+		syns -= previous
+	}
+	return float64(syns) / elapsed
+}
+
+// threshold returns the port scan threshold applying to IPs seen on a VLAN, 0 meaning untagged traffic.
+func (w *blockingWatcher) threshold(vlanID uint16) int {
+	if threshold, ok := w.options.VLANThresholds[vlanID]; ok && vlanID != 0 {
+		return threshold
+	}
+	return w.options.Threshold
+}
+
+// formatBanDuration returns a human-readable ban duration.
+func formatBanDuration(banDuration time.Duration) string {
+	if banDuration == 0 {
+		return "permanently"
+	}
+	return fmt.Sprintf("for %s", banDuration)
+}
@@ -0,0 +1,196 @@
+package watchers
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+// possibleCPUs returns the number of values of per-CPU maps.
+func possibleCPUs(t *testing.T) int {
+	counters := newTestMap(t, &ebpf.MapSpec{Type: ebpf.PerCPUArray, KeySize: 4, ValueSize: 8, MaxEntries: 1})
+	var values []uint64
+	require.NoError(t, counters.Lookup(uint32(0), &values))
+	return len(values)
+}
+
+// newTestSweepMap creates a map with the layout of sweep_map.
+func newTestSweepMap(t *testing.T, maxEntries uint32) *ebpf.Map {
+	return newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 32, ValueSize: 8, MaxEntries: maxEntries})
+}
+
+// newTestBlockingWatcher creates a blocking watcher reading a metric map and a sweep map, and blocking IPs in a
+// blocking map, all created for the test.
+func newTestBlockingWatcher(t *testing.T, options BlockingOptions) *blockingWatcher {
+	metricMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUCPUHash, KeySize: 16, ValueSize: ipMetricSize, MaxEntries: 16})
+	blockingMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: 8, MaxEntries: 16})
+	events, err := NewEventLogger("text", io.Discard)
+	require.NoError(t, err)
+
+	options.Window = time.Minute
+	options.Policy = NewBanPolicy([]time.Duration{time.Hour}, time.Hour)
+	options.Allowlist = &netaddr.IPSet{}
+	options.Events = events
+	return &blockingWatcher{
+		blocklist:    NewBlocklist(blockingMap, newTestBanInfoMap(t), options.Policy),
+		metricMap:    metricMap,
+		sweepMap:     newTestSweepMap(t, 64),
+		options:      options,
+		synBaseline:  make(map[netaddr.IP]uint64),
+		talkersTime:  time.Now(),
+		previousSYNs: make(map[netaddr.IP]uint64),
+	}
+}
+
+// putSYNs stores the SYN counter of an IP in the metric map, with a port seen now so the IP is not quiet.
+func putSYNs(t *testing.T, w *blockingWatcher, ip netaddr.IP, synReceived uint64) {
+	now, err := monotonicNow()
+	require.NoError(t, err)
+	values := make([][]byte, possibleCPUs(t))
+	for i := range values {
+		values[i] = make([]byte, ipMetricSize)
+	}
+	values[0] = marshalIPMetric(synReceived, 0, []uint16{80}, []uint64{now})
+	require.NoError(t, w.metricMap.Put(marshalIP(ip), values))
+}
+
+func TestSynRate(t *testing.T) {
+	ip := netaddr.IPv4(192, 0, 2, 1)
+	testCases := []struct {
+		name         string
+		previousSYNs map[netaddr.IP]uint64
+		synReceived  uint64
+		expected     float64
+	}{
+		{"SinceLastEvaluation", map[netaddr.IP]uint64{ip: 1000}, 1200, 100},
+		{"NewIP", map[netaddr.IP]uint64{}, 300, 150},
+		{"CounterStartedOver", map[netaddr.IP]uint64{ip: 1000}, 40, 20},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &blockingWatcher{previousSYNs: tc.previousSYNs}
+
+			assert.Equal(t, tc.expected, w.synRate(ip, tc.synReceived, 2))
+		})
+
+	}
+}
+
+func TestSearchInfringingIPsFloods(t *testing.T) {
+	steady := netaddr.IPv4(192, 0, 2, 1)
+	flooder := netaddr.IPv4(192, 0, 2, 2)
+	w := newTestBlockingWatcher(t, BlockingOptions{Threshold: 3, FloodThreshold: 100})
+	putSYNs(t, w, steady, 100000)
+	putSYNs(t, w, flooder, 100000)
+	w.previousSYNs = map[netaddr.IP]uint64{steady: 99990, flooder: 50000}
+	w.previousTime = time.Now().Add(-time.Second)
+
+	require.NoError(t, w.searchInfringingIPs())
+
+	blocked, err := w.blocklist.isBlocked(steady)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	blocked, err = w.blocklist.isBlocked(flooder)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	assert.Equal(t, map[netaddr.IP]uint64{steady: 100000}, w.previousSYNs)
+}
+
+func TestSearchInfringingIPsSeedsSkippedIPs(t *testing.T) {
+	ip := netaddr.IPv4(192, 0, 2, 1)
+	w := newTestBlockingWatcher(t, BlockingOptions{Threshold: 3, FloodThreshold: 100})
+	// The IP is already blocked, for example by the XDP program, and was not seen at the previous evaluation
+	_, err := w.blocklist.Block(ip, time.Hour, reasonPortScan, time.Now())
+	require.NoError(t, err)
+	putSYNs(t, w, ip, 100000)
+	w.previousTime = time.Now().Add(-time.Second)
+
+	require.NoError(t, w.searchInfringingIPs())
+	assert.Equal(t, map[netaddr.IP]uint64{ip: 100000}, w.previousSYNs)
+
+	// Once unbanned, its rate is computed from the SYNs sent since the previous evaluation
+	require.NoError(t, w.blocklist.Pardon(ip))
+	putSYNs(t, w, ip, 100010)
+	w.previousTime = time.Now().Add(-time.Second)
+
+	require.NoError(t, w.searchInfringingIPs())
+	blocked, err := w.blocklist.isBlocked(ip)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+// sweepKeys lists the keys of a sweep map, sorted.
+func sweepKeys(t *testing.T, sweepMap *ebpf.Map) [][32]byte {
+	keys, _, err := iterateSweepMap(sweepMap)
+	require.NoError(t, err)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	return keys
+}
+
+func TestSearchSweeps(t *testing.T) {
+	scanner := netaddr.IPv4(192, 0, 2, 1)
+	quiet := netaddr.IPv4(192, 0, 2, 2)
+	stale := netaddr.IPv4(192, 0, 2, 3)
+	w := newTestBlockingWatcher(t, BlockingOptions{SweepThreshold: 2})
+	now, err := monotonicNow()
+	require.NoError(t, err)
+	for i := byte(1); i <= 3; i++ {
+		require.NoError(t, w.sweepMap.Put(marshalSweepKey(scanner, netaddr.IPv4(198, 51, 100, i)), now))
+		require.NoError(t, w.sweepMap.Put(marshalSweepKey(stale, netaddr.IPv4(198, 51, 100, i)), uint64(1)))
+	}
+	quietKey := marshalSweepKey(quiet, netaddr.IPv4(198, 51, 100, 1))
+	require.NoError(t, w.sweepMap.Put(quietKey, now))
+
+	require.NoError(t, w.searchSweeps())
+
+	blocked, err := w.blocklist.isBlocked(scanner)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	blocked, err = w.blocklist.isBlocked(quiet)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	// The entries of the banned IP and the entries older than the window are removed
+	assert.Equal(t, [][32]byte{quietKey}, sweepKeys(t, w.sweepMap))
+}
+
+func TestReadSweepMap(t *testing.T) {
+	// More entries than a batch, so the map is read in several batches
+	sweepMap := newTestSweepMap(t, 2*sweepBatchSize)
+	expected := make(map[[32]byte]uint64)
+	for i := 0; i < sweepBatchSize+100; i++ {
+		key := marshalSweepKey(netaddr.IPv4(192, 0, 2, 1), netaddr.IPv4(10, 0, byte(i>>8), byte(i)))
+		expected[key] = uint64(i)
+		require.NoError(t, sweepMap.Put(key, uint64(i)))
+	}
+
+	keys, seen, err := readSweepMap(sweepMap)
+	require.NoError(t, err)
+	result := make(map[[32]byte]uint64)
+	for i, key := range keys {
+		result[key] = seen[i]
+	}
+	assert.Equal(t, expected, result)
+}
+
+func TestDeleteSweepKeys(t *testing.T) {
+	sweepMap := newTestSweepMap(t, 16)
+	source := netaddr.IPv4(192, 0, 2, 1)
+	var keys [][32]byte
+	for i := byte(1); i <= 4; i++ {
+		key := marshalSweepKey(source, netaddr.IPv4(198, 51, 100, i))
+		keys = append(keys, key)
+		require.NoError(t, sweepMap.Put(key, uint64(1)))
+	}
+	// The second key was evicted in the meantime
+	require.NoError(t, sweepMap.Delete(keys[1]))
+
+	require.NoError(t, deleteSweepKeys(sweepMap, keys[:3]))
+	assert.Equal(t, [][32]byte{keys[3]}, sweepKeys(t, sweepMap))
+}
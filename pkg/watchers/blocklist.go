@@ -0,0 +1,295 @@
+package watchers
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"inet.af/netaddr"
+)
+
+// ErrNotBlocked is returned when unblocking an IP that is not blocked.
+var ErrNotBlocked = errors.New("ip is not blocked")
+
+// Ban is an IP blocked by the XDP program.
+type Ban struct {
+	IP        netaddr.IP
+	BlockTime time.Time
+	// Duration is how long the IP stays blocked, 0 means permanently
+	Duration time.Duration
+	Reason   string
+}
+
+// Expired tells if the ban is over.
+func (b *Ban) Expired(now time.Time) bool {
+	return banExpired(uint64(b.BlockTime.Unix()), b.Duration, now)
+}
+
+// banInfo is the userspace part of a ban, the BPF map only stores the block time.
+type banInfo struct {
+	duration time.Duration
+	reason   string
+}
+
+// banReasonSize is the size of the reason of a ban_info, see BAN_REASON_SIZE in types.h. Longer reasons are truncated.
+const banReasonSize = 64
+
+// banInfoSize is the size of a ban_info: the duration and the reason.
+const banInfoSize = 8 + banReasonSize
+
+// marshalBanInfo converts a banInfo into an eBPF ban_info.
+func marshalBanInfo(info banInfo) []byte {
+	data := make([]byte, banInfoSize)
+	hostEndian.PutUint64(data[:8], uint64(info.duration))
+	copy(data[8:], info.reason)
+	return data
+}
+
+// unmarshalBanInfo converts an eBPF ban_info into a banInfo.
+func unmarshalBanInfo(data []byte) banInfo {
+	reason := data[8:]
+	if end := bytes.IndexByte(reason, 0); end >= 0 {
+		reason = reason[:end]
+	}
+	return banInfo{
+		duration: time.Duration(hostEndian.Uint64(data[:8])),
+		reason:   string(reason),
+	}
+}
+
+// Blocklist manages the IPs blocked by the XDP program. The BPF blockingMap only knows when an IP was blocked, the
+// Blocklist keeps the duration and reason of each ban in the infoMap, so they survive restarts when the maps are
+// pinned. Bans without this information (for example if they were added to the map by something else) fall back on
+// the duration given by the BanPolicy.
+type Blocklist struct {
+	blockingMap *ebpf.Map
+	infoMap     *ebpf.Map
+	policy      *BanPolicy
+	mutex       sync.Mutex
+	// bans caches the content of the infoMap
+	bans map[netaddr.IP]banInfo
+}
+
+func NewBlocklist(blockingMap, infoMap *ebpf.Map, policy *BanPolicy) *Blocklist {
+	return &Blocklist{
+		blockingMap: blockingMap,
+		infoMap:     infoMap,
+		policy:      policy,
+		bans:        make(map[netaddr.IP]banInfo),
+	}
+}
+
+// Block adds an IP to the blocking map for the given duration, 0 meaning permanently.
+func (b *Blocklist) Block(ip netaddr.IP, duration time.Duration, reason string, now time.Time) (*Ban, error) {
+	ban := &Ban{
+		IP:        ip,
+		BlockTime: time.Unix(now.Unix(), 0),
+		Duration:  duration,
+		Reason:    reason,
+	}
+	if err := b.Restore(ban); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// Restore adds a ban to the blocking map keeping its block time, for example to restore bans after a reboot.
+func (b *Blocklist) Restore(ban *Ban) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	info := banInfo{
+		duration: ban.Duration,
+		reason:   ban.Reason,
+	}
+	key := marshalIP(ban.IP)
+	// The information is written first, so a ban is never listed without it
+	if err := b.infoMap.Put(key, marshalBanInfo(info)); err != nil {
+		return err
+	}
+	if err := b.blockingMap.Put(key, uint64(ban.BlockTime.Unix())); err != nil {
+		return err
+	}
+	b.bans[ban.IP] = info
+	return nil
+}
+
+// known tells if the Blocklist blocked the IP or recorded its ban.
+func (b *Blocklist) known(ip netaddr.IP) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	_, ok := b.lookupInfo(ip)
+	return ok
+}
+
+// unknownBans returns the bans of the blocking map the Blocklist does not know about, issued at or after since. They
+// were issued by the XDP program, see blockingWatcher.reconcileKernelBans.
+func (b *Blocklist) unknownBans(since time.Time) ([]*Ban, error) {
+	var key [16]byte
+	var blockTime uint64
+	var bans []*Ban
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries := b.blockingMap.Iterate()
+	for entries.Next(&key, &blockTime) {
+		ip := unmarshalIP(key)
+		if _, ok := b.lookupInfo(ip); ok || int64(blockTime) < since.Unix() {
+			continue
+		}
+		bans = append(bans, b.makeBan(ip, blockTime))
+	}
+	if err := entries.Err(); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// isBlocked tells if an IP is in the blocking map.
+func (b *Blocklist) isBlocked(ip netaddr.IP) (bool, error) {
+	var blockTime uint64
+	err := b.blockingMap.Lookup(marshalIP(ip), &blockTime)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unblock removes an IP from the blocking map. It returns ErrNotBlocked if the IP was not blocked.
+func (b *Blocklist) Unblock(ip netaddr.IP) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.forget(ip); err != nil {
+		return err
+	}
+	err := b.blockingMap.Delete(marshalIP(ip))
+	// The IP might have been evicted by the LRU in the meantime
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return ErrNotBlocked
+	}
+	return err
+}
+
+// UnblockExpired removes an expired ban from the blocking map. It returns ErrNotBlocked if the IP is no longer blocked
+// or was blocked again since the ban was listed, so an IP banned anew is not released with its previous ban.
+func (b *Blocklist) UnblockExpired(ban *Ban) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var blockTime uint64
+	err := b.blockingMap.Lookup(marshalIP(ban.IP), &blockTime)
+	if errors.Is(err, ebpf.ErrKeyNotExist) || (err == nil && blockTime != uint64(ban.BlockTime.Unix())) {
+		return ErrNotBlocked
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.forget(ban.IP); err != nil {
+		return err
+	}
+	err = b.blockingMap.Delete(marshalIP(ban.IP))
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return ErrNotBlocked
+	}
+	return err
+}
+
+// forget drops the duration and reason of the ban of an IP. The mutex must be held.
+func (b *Blocklist) forget(ip netaddr.IP) error {
+	delete(b.bans, ip)
+	err := b.infoMap.Delete(marshalIP(ip))
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Pardon unblocks an IP and forgets its offences, so it gets the shortest ban if it offends again.
+func (b *Blocklist) Pardon(ip netaddr.IP) error {
+	b.policy.Forgive(ip)
+	return b.Unblock(ip)
+}
+
+// List returns all the IPs currently in the blocking map, sorted by block time.
+func (b *Blocklist) List() ([]*Ban, error) {
+	var key [16]byte
+	var blockTime uint64
+	var bans []*Ban
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries := b.blockingMap.Iterate()
+	for entries.Next(&key, &blockTime) {
+		bans = append(bans, b.makeBan(unmarshalIP(key), blockTime))
+	}
+	if err := entries.Err(); err != nil {
+		return nil, err
+	}
+	if err := b.prune(bans); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].BlockTime.Before(bans[j].BlockTime)
+	})
+	return bans, nil
+}
+
+// prune forgets the userspace information of IPs that are no longer in the blocking map, for example because the LRU
+// evicted them. The mutex must be held.
+func (b *Blocklist) prune(bans []*Ban) error {
+	blocked := make(map[netaddr.IP]bool, len(bans))
+	for _, ban := range bans {
+		blocked[ban.IP] = true
+	}
+	for ip := range b.bans {
+		if blocked[ip] {
+			continue
+		}
+		if err := b.forget(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupInfo returns the duration and reason of the ban of an IP, reading them from the infoMap if they are not cached
+// yet, for example after a restart. The mutex must be held.
+func (b *Blocklist) lookupInfo(ip netaddr.IP) (banInfo, bool) {
+	if info, ok := b.bans[ip]; ok {
+		return info, true
+	}
+	var data []byte
+	if err := b.infoMap.Lookup(marshalIP(ip), &data); err != nil {
+		return banInfo{}, false
+	}
+	info := unmarshalBanInfo(data)
+	b.bans[ip] = info
+	return info, true
+}
+
+// makeBan joins the block time read from the blocking map with the userspace information about the ban. The mutex
+// must be held.
+func (b *Blocklist) makeBan(ip netaddr.IP, blockTime uint64) *Ban {
+	info, ok := b.lookupInfo(ip)
+	if !ok {
+		info = banInfo{
+			duration: b.policy.BanDuration(ip),
+			reason:   "unknown",
+		}
+	}
+	return &Ban{
+		IP:        ip,
+		BlockTime: time.Unix(int64(blockTime), 0),
+		Duration:  info.duration,
+		Reason:    info.reason,
+	}
+}
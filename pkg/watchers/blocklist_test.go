@@ -0,0 +1,119 @@
+package watchers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+// newTestBanInfoMap creates a map with the layout of ban_info_map.
+func newTestBanInfoMap(t *testing.T) *ebpf.Map {
+	return newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: banInfoSize, MaxEntries: 16})
+}
+
+func TestBanInfo(t *testing.T) {
+	testCases := []struct {
+		name     string
+		info     banInfo
+		expected banInfo
+	}{
+		{"Permanent", banInfo{reason: "manual"}, banInfo{reason: "manual"}},
+		{"Duration", banInfo{duration: time.Hour, reason: reasonSlowScan}, banInfo{duration: time.Hour, reason: reasonSlowScan}},
+		{"EmptyReason", banInfo{duration: time.Hour}, banInfo{duration: time.Hour}},
+		{
+			"LongReason",
+			banInfo{reason: strings.Repeat("a", banReasonSize+10)},
+			banInfo{reason: strings.Repeat("a", banReasonSize)},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := unmarshalBanInfo(marshalBanInfo(tc.info))
+
+			assert.Equal(t, tc.expected, result)
+		})
+
+	}
+}
+
+func TestBlocklistPrune(t *testing.T) {
+	blocked := netaddr.IPv4(192, 0, 2, 1)
+	evicted := netaddr.IPv4(192, 0, 2, 2)
+	infoMap := newTestBanInfoMap(t)
+	blocklist := NewBlocklist(nil, infoMap, NewBanPolicy([]time.Duration{time.Hour}, time.Hour))
+	for _, ip := range []netaddr.IP{blocked, evicted} {
+		blocklist.bans[ip] = banInfo{duration: time.Hour, reason: reasonPortScan}
+		require.NoError(t, infoMap.Put(marshalIP(ip), marshalBanInfo(blocklist.bans[ip])))
+	}
+
+	err := blocklist.prune([]*Ban{
+		{IP: blocked, BlockTime: time.Unix(1647000000, 0), Duration: time.Hour},
+		{IP: netaddr.IPv4(192, 0, 2, 3), BlockTime: time.Unix(1647000000, 0)},
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, map[netaddr.IP]banInfo{blocked: {duration: time.Hour, reason: reasonPortScan}}, blocklist.bans)
+	var data []byte
+	assert.ErrorIs(t, infoMap.Lookup(marshalIP(evicted), &data), ebpf.ErrKeyNotExist)
+}
+
+// TestBlocklistRestart makes sure the bans found in pinned maps keep their duration and reason, instead of getting the
+// duration of a first offence.
+func TestBlocklistRestart(t *testing.T) {
+	blockingMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: 8, MaxEntries: 16})
+	infoMap := newTestBanInfoMap(t)
+	policy := NewBanPolicy([]time.Duration{10 * time.Minute, 24 * time.Hour}, time.Hour)
+	blockTime := time.Unix(1647000000, 0)
+	manual := netaddr.IPv4(192, 0, 2, 1)
+	repeated := netaddr.IPv4(192, 0, 2, 2)
+	unknown := netaddr.IPv4(192, 0, 2, 3)
+	previous := NewBlocklist(blockingMap, infoMap, policy)
+	_, err := previous.Block(manual, 0, "abuse report", blockTime)
+	require.NoError(t, err)
+	_, err = previous.Block(repeated, 24*time.Hour, reasonSlowScan, blockTime)
+	require.NoError(t, err)
+	require.NoError(t, blockingMap.Put(marshalIP(unknown), uint64(blockTime.Unix())))
+
+	restarted := NewBlocklist(blockingMap, infoMap, NewBanPolicy([]time.Duration{10 * time.Minute, 24 * time.Hour}, time.Hour))
+	bans, err := restarted.List()
+
+	require.NoError(t, err)
+	byIP := make(map[netaddr.IP]*Ban)
+	for _, ban := range bans {
+		byIP[ban.IP] = ban
+	}
+	assert.Equal(t, &Ban{IP: manual, BlockTime: blockTime, Reason: "abuse report"}, byIP[manual])
+	assert.Equal(t, &Ban{IP: repeated, BlockTime: blockTime, Duration: 24 * time.Hour, Reason: reasonSlowScan}, byIP[repeated])
+	assert.Equal(t, &Ban{IP: unknown, BlockTime: blockTime, Duration: 10 * time.Minute, Reason: "unknown"}, byIP[unknown])
+	assert.True(t, restarted.known(repeated))
+	assert.False(t, restarted.known(unknown))
+
+	require.NoError(t, restarted.Unblock(repeated))
+	var data []byte
+	assert.ErrorIs(t, infoMap.Lookup(marshalIP(repeated), &data), ebpf.ErrKeyNotExist)
+}
+
+func TestBlocklistUnknownBans(t *testing.T) {
+	blockingMap := newTestMap(t, &ebpf.MapSpec{Type: ebpf.LRUHash, KeySize: 16, ValueSize: 8, MaxEntries: 16})
+	blocklist := NewBlocklist(blockingMap, newTestBanInfoMap(t), NewBanPolicy([]time.Duration{time.Hour}, time.Hour))
+	start := time.Unix(1647000000, 0)
+	known := netaddr.IPv4(192, 0, 2, 1)
+	kernelBan := netaddr.IPv4(192, 0, 2, 2)
+	_, err := blocklist.Block(known, time.Hour, reasonPortScan, start.Add(time.Second))
+	require.NoError(t, err)
+	require.NoError(t, blockingMap.Put(marshalIP(kernelBan), uint64(start.Unix())))
+	require.NoError(t, blockingMap.Put(marshalIP(netaddr.IPv4(192, 0, 2, 3)), uint64(start.Unix()-1)))
+
+	bans, err := blocklist.unknownBans(start)
+
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, kernelBan, bans[0].IP)
+	assert.True(t, blocklist.known(known))
+	assert.False(t, blocklist.known(kernelBan))
+}
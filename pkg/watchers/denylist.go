@@ -0,0 +1,237 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/hugoshaka/teleport-challenge/bpf"
+	"github.com/hugoshaka/teleport-challenge/pkg/iplist"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"inet.af/netaddr"
+)
+
+var (
+	deniedPrefixes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "teleportchallenge_denied_prefixes",
+		Help: "The number of prefixes currently in the denylist.",
+	})
+)
+
+var (
+	// ErrNotDenied is returned when removing a prefix that is not in the denylist.
+	ErrNotDenied = errors.New("prefix is not denied")
+	// ErrDeniedByFile is returned when removing a prefix that comes from the denylist file, it must be removed from
+	// the file instead or it would come back on the next reload.
+	ErrDeniedByFile = errors.New("prefix is denied by the denylist file")
+)
+
+// Sources of the denied prefixes.
+const (
+	DenySourceFile   = "file"
+	DenySourceManual = "manual"
+)
+
+// DeniedPrefix is a prefix of the denylist and where it comes from.
+type DeniedPrefix struct {
+	Prefix netaddr.IPPrefix
+	Source string
+}
+
+// Denylist manages the prefixes dropped by the XDP program. They come from the denylist file, which is reloaded
+// on SIGHUP, and from the admin API. The BPF deniedMap holds the union of both, manual prefixes are kept in memory
+// only and are lost on restart.
+type Denylist struct {
+	deniedMap *ebpf.Map
+	mutex     sync.Mutex
+	fromFile  map[netaddr.IPPrefix]bool
+	manual    map[netaddr.IPPrefix]bool
+}
+
+func NewDenylist(deniedMap *ebpf.Map) *Denylist {
+	return &Denylist{
+		deniedMap: deniedMap,
+		fromFile:  make(map[netaddr.IPPrefix]bool),
+		manual:    make(map[netaddr.IPPrefix]bool),
+	}
+}
+
+// Load replaces the prefixes of the denylist file with the given ones, keeping the manual prefixes.
+func (d *Denylist) Load(prefixes []netaddr.IPPrefix) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	added, removed := diffPrefixes(d.fromFile, prefixes)
+
+	for _, prefix := range added {
+		if !d.manual[prefix] {
+			if err := d.deniedMap.Put(bpf.NewLPMKey(prefix), uint8(1)); err != nil {
+				log.Printf("Error denying a prefix: %v", err)
+				return err
+			}
+		}
+		d.fromFile[prefix] = true
+	}
+
+	for _, prefix := range removed {
+		if !d.manual[prefix] {
+			if err := d.deletePrefix(prefix); err != nil {
+				log.Printf("Error removing a prefix from the denylist: %v", err)
+				return err
+			}
+		}
+		delete(d.fromFile, prefix)
+	}
+
+	log.Printf("Denylist loaded: %d prefixes added, %d removed, %d denied", len(added), len(removed), d.count())
+	deniedPrefixes.Set(float64(d.count()))
+	return nil
+}
+
+// Deny adds a prefix to the denylist until it is removed or the daemon restarts.
+func (d *Denylist) Deny(prefix netaddr.IPPrefix) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.fromFile[prefix] && !d.manual[prefix] {
+		if err := d.deniedMap.Put(bpf.NewLPMKey(prefix), uint8(1)); err != nil {
+			return err
+		}
+	}
+	d.manual[prefix] = true
+	deniedPrefixes.Set(float64(d.count()))
+	return nil
+}
+
+// Remove removes a prefix added with Deny. It returns ErrDeniedByFile if the prefix comes from the denylist file and
+// ErrNotDenied if it is not in the denylist.
+func (d *Denylist) Remove(prefix netaddr.IPPrefix) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.fromFile[prefix] {
+		return ErrDeniedByFile
+	}
+	if !d.manual[prefix] {
+		return ErrNotDenied
+	}
+	if err := d.deletePrefix(prefix); err != nil {
+		return err
+	}
+	delete(d.manual, prefix)
+	deniedPrefixes.Set(float64(d.count()))
+	return nil
+}
+
+// List returns the prefixes of the denylist sorted by address.
+func (d *Denylist) List() []DeniedPrefix {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	denied := make([]DeniedPrefix, 0, d.count())
+	for prefix := range d.fromFile {
+		denied = append(denied, DeniedPrefix{Prefix: prefix, Source: DenySourceFile})
+	}
+	for prefix := range d.manual {
+		if !d.fromFile[prefix] {
+			denied = append(denied, DeniedPrefix{Prefix: prefix, Source: DenySourceManual})
+		}
+	}
+	sort.Slice(denied, func(i, j int) bool {
+		if denied[i].Prefix.IP() != denied[j].Prefix.IP() {
+			return denied[i].Prefix.IP().Less(denied[j].Prefix.IP())
+		}
+		return denied[i].Prefix.Bits() < denied[j].Prefix.Bits()
+	})
+	return denied
+}
+
+// count returns the number of prefixes in the deniedMap, the mutex must be held.
+func (d *Denylist) count() int {
+	count := len(d.fromFile)
+	for prefix := range d.manual {
+		if !d.fromFile[prefix] {
+			count++
+		}
+	}
+	return count
+}
+
+// deletePrefix removes a prefix from the deniedMap, ignoring prefixes already missing.
+func (d *Denylist) deletePrefix(prefix netaddr.IPPrefix) error {
+	err := d.deniedMap.Delete(bpf.NewLPMKey(prefix))
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// denylistWatcher loads the denylist file into the Denylist at startup and every time the reload channel fires.
+type denylistWatcher struct {
+	denylist *Denylist
+	path     string
+	reload   <-chan os.Signal
+}
+
+func NewDenylistWatcher(denylist *Denylist, path string, reload <-chan os.Signal) Watcher {
+	return &denylistWatcher{
+		denylist: denylist,
+		path:     path,
+		reload:   reload,
+	}
+}
+
+// Run loads the denylist, then reloads it on every signal until the context is cancelled, or if we face an error.
+// An invalid denylist is fatal at startup, but only logged on reload so a typo does not stop the firewall.
+func (w *denylistWatcher) Run(ctx context.Context) error {
+	prefixes, err := iplist.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if err := w.denylist.Load(prefixes); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-w.reload:
+			prefixes, err := iplist.ReadFile(w.path)
+			if err != nil {
+				log.Printf("Error reloading the denylist, keeping the previous one: %v", err)
+				continue
+			}
+			if err := w.denylist.Load(prefixes); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			log.Println("Stopping denylist watcher")
+			return nil
+		}
+	}
+}
+
+// diffPrefixes compares the current set of prefixes with the wanted ones and returns which ones must be added
+// and removed.
+func diffPrefixes(current map[netaddr.IPPrefix]bool, wanted []netaddr.IPPrefix) ([]netaddr.IPPrefix, []netaddr.IPPrefix) {
+	var added, removed []netaddr.IPPrefix
+	wantedSet := make(map[netaddr.IPPrefix]bool, len(wanted))
+
+	for _, prefix := range wanted {
+		if !current[prefix] && !wantedSet[prefix] {
+			added = append(added, prefix)
+		}
+		wantedSet[prefix] = true
+	}
+	for prefix := range current {
+		if !wantedSet[prefix] {
+			removed = append(removed, prefix)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,56 @@
+package watchers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestDiffPrefixes(t *testing.T) {
+	testCases := []struct {
+		name            string
+		current         map[netaddr.IPPrefix]bool
+		wanted          []netaddr.IPPrefix
+		expectedAdded   []netaddr.IPPrefix
+		expectedRemoved []netaddr.IPPrefix
+	}{
+		{
+			"InitialLoad",
+			map[netaddr.IPPrefix]bool{},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24"), netaddr.MustParseIPPrefix("198.51.100.0/24")},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24"), netaddr.MustParseIPPrefix("198.51.100.0/24")},
+			nil,
+		},
+		{
+			"Unchanged",
+			map[netaddr.IPPrefix]bool{netaddr.MustParseIPPrefix("192.0.2.0/24"): true},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+			nil,
+			nil,
+		},
+		{
+			"AddedAndRemoved",
+			map[netaddr.IPPrefix]bool{netaddr.MustParseIPPrefix("192.0.2.0/24"): true},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("198.51.100.0/24"), netaddr.MustParseIPPrefix("198.51.100.0/24")},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("198.51.100.0/24")},
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+		},
+		{
+			"Emptied",
+			map[netaddr.IPPrefix]bool{netaddr.MustParseIPPrefix("192.0.2.0/24"): true},
+			nil,
+			nil,
+			[]netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.0.2.0/24")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			added, removed := diffPrefixes(tc.current, tc.wanted)
+
+			assert.Equal(t, tc.expectedAdded, added)
+			assert.Equal(t, tc.expectedRemoved, removed)
+		})
+
+	}
+}
@@ -0,0 +1,301 @@
+package watchers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Event types, as found in the "event" field of JSON events
+const (
+	eventConnection = "connection"
+	eventBan        = "ban"
+	eventWouldBan   = "would_ban"
+	eventBanSkipped = "ban_skipped"
+	eventUnban      = "unban"
+)
+
+// Ban reasons
+const (
+	reasonPortScan    = "port scan"
+	reasonUDPPortScan = "udp port scan"
+	reasonSweep       = "sweep"
+	reasonSlowScan    = "slow scan"
+	reasonSYNFlood    = "syn flood"
+	reasonBanExpired  = "ban expired"
+)
+
+// event is a connection or ban decision, as output in JSON format.
+type event struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Type          string    `json:"event"`
+	Interface     string    `json:"interface,omitempty"`
+	Protocol      string    `json:"protocol,omitempty"`
+	SourceIP      string    `json:"source_ip"`
+	SourcePort    *uint16   `json:"source_port,omitempty"`
+	DestIP        string    `json:"dest_ip,omitempty"`
+	DestPort      *uint16   `json:"dest_port,omitempty"`
+	VLAN          uint16    `json:"vlan,omitempty"`
+	Ports         []uint16  `json:"ports,omitempty"`
+	DestIPs       []string  `json:"dest_ips,omitempty"`
+	DistinctPorts int       `json:"distinct_ports,omitempty"`
+	Techniques    []string  `json:"techniques,omitempty"`
+	SYNRate       float64   `json:"syn_rate,omitempty"`
+	Offence       int       `json:"offence,omitempty"`
+	BanDuration   string    `json:"ban_duration,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+// EventLogger outputs connections and ban decisions, either as free text through the standard logger or as JSON
+// objects, one per line, so they can be ingested without parsing.
+type EventLogger struct {
+	format    string
+	mutex     sync.Mutex
+	encoder   *json.Encoder
+	timeNowFn func() time.Time
+}
+
+// NewEventLogger creates an EventLogger. JSON events are written to out.
+func NewEventLogger(format string, out io.Writer) (*EventLogger, error) {
+	if format != LogFormatText && format != LogFormatJSON {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &EventLogger{
+		format:    format,
+		encoder:   json.NewEncoder(out),
+		timeNowFn: time.Now,
+	}, nil
+}
+
+// logConnection outputs a new TCP connection or UDP flow.
+func (l *EventLogger) logConnection(c *connectionRecord) {
+	if l.format == LogFormatText {
+		if c.protocol == protocolUDP {
+			log.Printf("New UDP flow on %s: %s", c.iface, c)
+			return
+		}
+		log.Printf("New connection on %s: %s", c.iface, c)
+		return
+	}
+	l.write(event{
+		Type:       eventConnection,
+		Interface:  c.iface,
+		Protocol:   c.protocol,
+		SourceIP:   c.sourceIP.String(),
+		SourcePort: &c.sourcePort,
+		DestIP:     c.destIP.String(),
+		DestPort:   &c.destPort,
+		VLAN:       c.vlanID,
+	})
+}
+
+// logBan outputs the ban of an IP caught scanning the ports of a protocol, with the scan techniques it used for TCP.
+// In dry run mode the IP is not actually banned.
+func (l *EventLogger) logBan(ip netaddr.IP, metric *ipMetric, protocol string, ports []uint16, count int, banDuration time.Duration, dryRun bool) {
+	var techniques []string
+	title, reason := "Port scan", reasonPortScan
+	if protocol == protocolUDP {
+		title, reason = "UDP port scan", reasonUDPPortScan
+	} else {
+		techniques = formatScanTypes(metric.scanTypes)
+	}
+	if l.format == LogFormatText {
+		if dryRun {
+			log.Printf("%s detected: %v%s on ports %v%s, offence #%d, would be banned %s (dry run)", title, ip, formatVLAN(metric.vlanID), ports, formatTechniques(techniques), count, formatBanDuration(banDuration))
+			return
+		}
+		log.Printf("%s detected: %v%s on ports %v%s, offence #%d, banned %s", title, ip, formatVLAN(metric.vlanID), ports, formatTechniques(techniques), count, formatBanDuration(banDuration))
+		return
+	}
+	eventType := eventBan
+	if dryRun {
+		eventType = eventWouldBan
+	}
+	l.write(event{
+		Type:        eventType,
+		Interface:   metric.iface,
+		Protocol:    protocol,
+		SourceIP:    ip.String(),
+		VLAN:        metric.vlanID,
+		Ports:       ports,
+		Techniques:  techniques,
+		Offence:     count,
+		BanDuration: formatJSONBanDuration(banDuration),
+		Reason:      reason,
+	})
+}
+
+// logSweep outputs the ban of an IP caught probing many destination IPs. In dry run mode the IP is not actually banned.
+func (l *EventLogger) logSweep(ip netaddr.IP, dests []netaddr.IP, count int, banDuration time.Duration, dryRun bool) {
+	if l.format == LogFormatText {
+		if dryRun {
+			log.Printf("Sweep detected: %v probed %d hosts %v, offence #%d, would be banned %s (dry run)", ip, len(dests), dests, count, formatBanDuration(banDuration))
+			return
+		}
+		log.Printf("Sweep detected: %v probed %d hosts %v, offence #%d, banned %s", ip, len(dests), dests, count, formatBanDuration(banDuration))
+		return
+	}
+	eventType := eventBan
+	if dryRun {
+		eventType = eventWouldBan
+	}
+	destIPs := make([]string, 0, len(dests))
+	for _, dest := range dests {
+		destIPs = append(destIPs, dest.String())
+	}
+	l.write(event{
+		Type:        eventType,
+		SourceIP:    ip.String(),
+		DestIPs:     destIPs,
+		Offence:     count,
+		BanDuration: formatJSONBanDuration(banDuration),
+		Reason:      reasonSweep,
+	})
+}
+
+// logSlowScan outputs the ban of an IP caught contacting too many distinct ports over 24 hours. In dry run mode the IP
+// is not actually banned.
+func (l *EventLogger) logSlowScan(ip netaddr.IP, metric *ipMetric, distinctPorts int, count int, banDuration time.Duration, dryRun bool) {
+	if l.format == LogFormatText {
+		if dryRun {
+			log.Printf("Slow scan detected: %v%s on ~%d distinct ports over 24h, offence #%d, would be banned %s (dry run)", ip, formatVLAN(metric.vlanID), distinctPorts, count, formatBanDuration(banDuration))
+			return
+		}
+		log.Printf("Slow scan detected: %v%s on ~%d distinct ports over 24h, offence #%d, banned %s", ip, formatVLAN(metric.vlanID), distinctPorts, count, formatBanDuration(banDuration))
+		return
+	}
+	eventType := eventBan
+	if dryRun {
+		eventType = eventWouldBan
+	}
+	l.write(event{
+		Type:          eventType,
+		Interface:     metric.iface,
+		SourceIP:      ip.String(),
+		VLAN:          metric.vlanID,
+		DistinctPorts: distinctPorts,
+		Offence:       count,
+		BanDuration:   formatJSONBanDuration(banDuration),
+		Reason:        reasonSlowScan,
+	})
+}
+
+// logSYNFlood outputs the ban of an IP caught sending SYNs faster than the flood threshold. In dry run mode the IP is
+// not actually banned.
+func (l *EventLogger) logSYNFlood(ip netaddr.IP, metric *ipMetric, synRate float64, count int, banDuration time.Duration, dryRun bool) {
+	if l.format == LogFormatText {
+		if dryRun {
+			log.Printf("SYN flood detected: %v%s at %.0f SYN/s, offence #%d, would be banned %s (dry run)", ip, formatVLAN(metric.vlanID), synRate, count, formatBanDuration(banDuration))
+			return
+		}
+		log.Printf("SYN flood detected: %v%s at %.0f SYN/s, offence #%d, banned %s", ip, formatVLAN(metric.vlanID), synRate, count, formatBanDuration(banDuration))
+		return
+	}
+	eventType := eventBan
+	if dryRun {
+		eventType = eventWouldBan
+	}
+	l.write(event{
+		Type:        eventType,
+		Interface:   metric.iface,
+		SourceIP:    ip.String(),
+		VLAN:        metric.vlanID,
+		SYNRate:     synRate,
+		Offence:     count,
+		BanDuration: formatJSONBanDuration(banDuration),
+		Reason:      reasonSYNFlood,
+	})
+}
+
+// logBanSkipped outputs a port scan that did not lead to a ban.
+func (l *EventLogger) logBanSkipped(ip netaddr.IP, metric *ipMetric, reason string) {
+	if l.format == LogFormatText {
+		log.Printf("Port scan detected from %s IP %v%s, not blocking", reason, ip, formatVLAN(metric.vlanID))
+		return
+	}
+	l.write(event{
+		Type:      eventBanSkipped,
+		Interface: metric.iface,
+		SourceIP:  ip.String(),
+		VLAN:      metric.vlanID,
+		Reason:    reason,
+	})
+}
+
+// logUnban outputs the release of an IP whose ban expired.
+func (l *EventLogger) logUnban(ip netaddr.IP) {
+	if l.format == LogFormatText {
+		log.Printf("Ban expired, unblocking %v", ip)
+		return
+	}
+	l.write(event{
+		Type:     eventUnban,
+		SourceIP: ip.String(),
+		Reason:   reasonBanExpired,
+	})
+}
+
+// LogManualBan outputs the ban of an IP requested by an operator.
+func (l *EventLogger) LogManualBan(ban *Ban) {
+	if l.format == LogFormatText {
+		log.Printf("Manual ban: %v banned %s (%s)", ban.IP, formatBanDuration(ban.Duration), ban.Reason)
+		return
+	}
+	l.write(event{
+		Type:        eventBan,
+		SourceIP:    ban.IP.String(),
+		BanDuration: formatJSONBanDuration(ban.Duration),
+		Reason:      ban.Reason,
+	})
+}
+
+// LogManualUnban outputs the release of an IP requested by an operator.
+func (l *EventLogger) LogManualUnban(ip netaddr.IP) {
+	if l.format == LogFormatText {
+		log.Printf("Manual unban: unblocking %v", ip)
+		return
+	}
+	l.write(event{
+		Type:     eventUnban,
+		SourceIP: ip.String(),
+		Reason:   "manual",
+	})
+}
+
+// write outputs a JSON event. Events come from several watchers, the mutex keeps lines from interleaving.
+func (l *EventLogger) write(e event) {
+	e.Timestamp = l.timeNowFn().UTC()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.encoder.Encode(e); err != nil {
+		log.Printf("Error writing event: %v", err)
+	}
+}
+
+// formatTechniques returns a scan techniques suffix for log lines, or nothing if they are unknown.
+func formatTechniques(techniques []string) string {
+	if len(techniques) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(techniques, ", "))
+}
+
+// formatJSONBanDuration returns a ban duration for JSON events.
+func formatJSONBanDuration(banDuration time.Duration) string {
+	if banDuration == 0 {
+		return "permanent"
+	}
+	return banDuration.String()
+}
@@ -0,0 +1,123 @@
+package watchers
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestEventLoggerJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		logFn    func(l *EventLogger)
+		expected string
+	}{
+		{
+			"Connection",
+			func(l *EventLogger) {
+				l.logConnection(&connectionRecord{
+					sourceIP:   netaddr.IPv4(192, 0, 2, 1),
+					destIP:     netaddr.IPv4(192, 0, 2, 2),
+					sourcePort: 35682,
+					destPort:   22,
+					protocol:   protocolTCP,
+					iface:      "eth0",
+				})
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"connection","interface":"eth0","protocol":"tcp","source_ip":"192.0.2.1","source_port":35682,"dest_ip":"192.0.2.2","dest_port":22}`,
+		},
+		{
+			"PortZero",
+			func(l *EventLogger) {
+				l.logConnection(&connectionRecord{
+					sourceIP:   netaddr.IPv4(192, 0, 2, 1),
+					destIP:     netaddr.IPv4(192, 0, 2, 2),
+					sourcePort: 0,
+					destPort:   0,
+					protocol:   protocolUDP,
+					iface:      "eth0",
+				})
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"connection","interface":"eth0","protocol":"udp","source_ip":"192.0.2.1","source_port":0,"dest_ip":"192.0.2.2","dest_port":0}`,
+		},
+		{
+			"Ban",
+			func(l *EventLogger) {
+				l.logBan(netaddr.MustParseIP("2001:db8::1"), &ipMetric{vlanID: 100, iface: "eth0"}, protocolTCP, []uint16{22, 80, 443, 8080}, 2, time.Hour, false)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban","interface":"eth0","protocol":"tcp","source_ip":"2001:db8::1","vlan":100,"ports":[22,80,443,8080],"offence":2,"ban_duration":"1h0m0s","reason":"port scan"}`,
+		},
+		{
+			"StealthScanBan",
+			func(l *EventLogger) {
+				l.logBan(netaddr.IPv4(192, 0, 2, 1), &ipMetric{scanTypes: scanFIN | scanXmas}, protocolTCP, []uint16{22, 80, 443, 8080}, 1, time.Hour, false)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban","protocol":"tcp","source_ip":"192.0.2.1","ports":[22,80,443,8080],"techniques":["FIN","Xmas"],"offence":1,"ban_duration":"1h0m0s","reason":"port scan"}`,
+		},
+		{
+			"DryRunBan",
+			func(l *EventLogger) {
+				l.logBan(netaddr.IPv4(192, 0, 2, 1), &ipMetric{}, protocolTCP, []uint16{22, 80, 443, 8080}, 1, 0, true)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"would_ban","protocol":"tcp","source_ip":"192.0.2.1","ports":[22,80,443,8080],"offence":1,"ban_duration":"permanent","reason":"port scan"}`,
+		},
+		{
+			"UDPScanBan",
+			func(l *EventLogger) {
+				l.logBan(netaddr.IPv4(192, 0, 2, 1), &ipMetric{scanTypes: scanSYN | scanUDP}, protocolUDP, []uint16{53, 123, 161, 500}, 1, time.Hour, false)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban","protocol":"udp","source_ip":"192.0.2.1","ports":[53,123,161,500],"offence":1,"ban_duration":"1h0m0s","reason":"udp port scan"}`,
+		},
+		{
+			"Sweep",
+			func(l *EventLogger) {
+				l.logSweep(netaddr.IPv4(192, 0, 2, 1), []netaddr.IP{netaddr.IPv4(198, 51, 100, 1), netaddr.IPv4(198, 51, 100, 2)}, 1, time.Hour, true)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"would_ban","source_ip":"192.0.2.1","dest_ips":["198.51.100.1","198.51.100.2"],"offence":1,"ban_duration":"1h0m0s","reason":"sweep"}`,
+		},
+		{
+			"SlowScan",
+			func(l *EventLogger) {
+				l.logSlowScan(netaddr.IPv4(192, 0, 2, 1), &ipMetric{}, 42, 1, 24*time.Hour, false)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban","source_ip":"192.0.2.1","distinct_ports":42,"offence":1,"ban_duration":"24h0m0s","reason":"slow scan"}`,
+		},
+		{
+			"SYNFlood",
+			func(l *EventLogger) {
+				l.logSYNFlood(netaddr.IPv4(192, 0, 2, 1), &ipMetric{iface: "eth1"}, 1500, 1, 10*time.Minute, false)
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban","interface":"eth1","source_ip":"192.0.2.1","syn_rate":1500,"offence":1,"ban_duration":"10m0s","reason":"syn flood"}`,
+		},
+		{
+			"BanSkipped",
+			func(l *EventLogger) {
+				l.logBanSkipped(netaddr.IPv4(192, 0, 2, 1), &ipMetric{iface: "eth0"}, "allowlisted")
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"ban_skipped","interface":"eth0","source_ip":"192.0.2.1","reason":"allowlisted"}`,
+		},
+		{
+			"Unban",
+			func(l *EventLogger) {
+				l.logUnban(netaddr.IPv4(192, 0, 2, 1))
+			},
+			`{"timestamp":"2022-03-11T12:00:00Z","event":"unban","source_ip":"192.0.2.1","reason":"ban expired"}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger, err := NewEventLogger(LogFormatJSON, &out)
+			assert.NoError(t, err)
+			logger.timeNowFn = func() time.Time { return time.Date(2022, 3, 11, 12, 0, 0, 0, time.UTC) }
+
+			tc.logFn(logger)
+
+			assert.JSONEq(t, tc.expected, out.String())
+		})
+
+	}
+}
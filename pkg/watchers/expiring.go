@@ -0,0 +1,94 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"time"
+)
+
+var (
+	ipsUnblocked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "teleportchallenge_ips_unblocked_total",
+		Help: "The number of IPs unblocked because their ban expired since the start of the application.",
+	})
+)
+
+// expiringWatcher reads the Blocklist and unblocks IPs whose ban has expired.
+type expiringWatcher struct {
+	blocklist *Blocklist
+	period    time.Duration
+	policy    *BanPolicy
+	events    *EventLogger
+}
+
+func NewExpiringWatcher(blocklist *Blocklist, period time.Duration, policy *BanPolicy, events *EventLogger) Watcher {
+	return &expiringWatcher{
+		blocklist: blocklist,
+		period:    period,
+		policy:    policy,
+		events:    events,
+	}
+}
+
+// Run executes releaseExpiredIPs at every tick until the context is cancelled, or if we face an error.
+func (w *expiringWatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.period)
+
+	for {
+		select {
+		case <-ticker.C:
+			err := w.releaseExpiredIPs()
+			if err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			log.Println("Stopping expiring watcher")
+			return nil
+		}
+	}
+}
+
+// releaseExpiredIPs walks the Blocklist and removes every IP that has been blocked for longer than its ban duration.
+// It also makes the BanPolicy forget about IPs that stayed quiet long enough.
+func (w *expiringWatcher) releaseExpiredIPs() error {
+	now := time.Now()
+
+	// Deleting keys while iterating over a hash map can restart the iteration, so we list them first
+	bans, err := w.blocklist.List()
+	if err != nil {
+		log.Printf("Error reading ip_blocked_map: %s", err)
+		return err
+	}
+
+	for _, ban := range bans {
+		if !ban.Expired(now) {
+			continue
+		}
+		err := w.blocklist.UnblockExpired(ban)
+		// The IP might have been evicted by the LRU, unblocked or blocked again in the meantime
+		if errors.Is(err, ErrNotBlocked) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error unblocking an IP: %v", err)
+			return err
+		}
+		w.events.logUnban(ban.IP)
+		ipsUnblocked.Inc()
+	}
+
+	w.policy.Forget(now)
+	return nil
+}
+
+// banExpired tells if an IP blocked at blockTime (epoch timestamp) should be released. A ban duration of 0 never expires.
+func banExpired(blockTime uint64, banDuration time.Duration, now time.Time) bool {
+	if banDuration == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(int64(blockTime), 0)) >= banDuration
+}
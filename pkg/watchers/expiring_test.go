@@ -0,0 +1,57 @@
+package watchers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanExpired(t *testing.T) {
+	now := time.Unix(1647000000, 0)
+	testCases := []struct {
+		name        string
+		blockTime   uint64
+		banDuration time.Duration
+		expected    bool
+	}{
+		{
+			"JustBlocked",
+			1647000000,
+			time.Hour,
+			false,
+		},
+		{
+			"StillBlocked",
+			1646999000,
+			time.Hour,
+			false,
+		},
+		{
+			"ExactlyExpired",
+			1646996400,
+			time.Hour,
+			true,
+		},
+		{
+			"LongExpired",
+			1640000000,
+			time.Hour,
+			true,
+		},
+		{
+			"Permanent",
+			1640000000,
+			0,
+			false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := banExpired(tc.blockTime, tc.banDuration, now)
+
+			assert.Equal(t, tc.expected, result)
+		})
+
+	}
+}
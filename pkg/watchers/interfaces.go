@@ -0,0 +1,204 @@
+package watchers
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// interfaceNames resolves interface indexes into names. Names are cached since every connection record carries the
+// index of the interface it was received on.
+type interfaceNames struct {
+	mutex    sync.Mutex
+	names    map[uint32]string
+	lookupFn func(index int) (*net.Interface, error)
+}
+
+func newInterfaceNames() *interfaceNames {
+	return &interfaceNames{
+		names:    make(map[uint32]string),
+		lookupFn: net.InterfaceByIndex,
+	}
+}
+
+// name returns the name of an interface, or a placeholder built from its index if it does not exist anymore.
+func (n *interfaceNames) name(ifindex uint32) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if name, ok := n.names[ifindex]; ok {
+		return name
+	}
+	iface, err := n.lookupFn(int(ifindex))
+	if err != nil {
+		return fmt.Sprintf("if%d", ifindex)
+	}
+	n.names[ifindex] = iface.Name
+	return iface.Name
+}
+
+// forget drops the cached name of an interface.
+func (n *interfaceNames) forget(ifindex uint32) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.names, ifindex)
+}
+
+var (
+	attachedInterfaces = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "teleportchallenge_attached_interfaces",
+		Help: "The number of interfaces the XDP program is currently attached to.",
+	})
+)
+
+// interfaceCache resolves the interface names of the connections, it is shared by the tracking watcher and the
+// interface watcher which invalidates the names of renamed or deleted interfaces.
+var interfaceCache = newInterfaceNames()
+
+// Attacher attaches the XDP program to interfaces, see bpf.Loader.
+type Attacher interface {
+	Attach(iface net.Interface) error
+	Detach(name string) error
+}
+
+// interfaceWatcher follows the interfaces created, deleted or renamed at runtime through rtnetlink, and attaches the
+// XDP program to the ones matching the interface patterns.
+type interfaceWatcher struct {
+	attacher Attacher
+	patterns []string
+	// attached are the names of the interfaces the XDP program is attached to, indexed by interface index
+	attached map[int]string
+	listFn   func() ([]net.Interface, error)
+}
+
+// NewInterfaceWatcher creates a watcher for the interfaces matching the patterns (see filepath.Match), the XDP program
+// being already attached to the given interfaces.
+func NewInterfaceWatcher(attacher Attacher, patterns []string, attached []net.Interface) Watcher {
+	w := &interfaceWatcher{
+		attacher: attacher,
+		patterns: patterns,
+		attached: make(map[int]string),
+		listFn:   net.Interfaces,
+	}
+	for _, iface := range attached {
+		w.attached[iface.Index] = iface.Name
+	}
+	attachedInterfaces.Set(float64(len(w.attached)))
+	return w
+}
+
+// Run handles link notifications until the context is cancelled, or if we face an error. The subscription stops when
+// notifications are lost because we were too slow, we then subscribe again and list the interfaces.
+func (w *interfaceWatcher) Run(ctx context.Context) error {
+	for {
+		done := make(chan struct{})
+		updates := make(chan netlink.LinkUpdate, linkUpdatesBuffer)
+		err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+			ErrorCallback: func(err error) {
+				// Closing the subscription on shutdown makes the pending read fail
+				if ctx.Err() == nil {
+					log.Printf("Error reading netlink notifications: %v", err)
+				}
+			},
+		})
+		if err != nil {
+			close(done)
+			return fmt.Errorf("subscribing to netlink notifications: %w", err)
+		}
+
+		// Interfaces might have changed before the subscription, or while notifications were lost
+		if err := w.resync(); err != nil {
+			close(done)
+			return err
+		}
+		w.handleUpdates(ctx, updates)
+		close(done)
+
+		if ctx.Err() != nil {
+			log.Println("Stopping interface watcher")
+			return nil
+		}
+		log.Println("Netlink subscription lost, subscribing again and listing interfaces")
+	}
+}
+
+// handleUpdates handles link notifications until the subscription stops or the context is cancelled.
+func (w *interfaceWatcher) handleUpdates(ctx context.Context, updates <-chan netlink.LinkUpdate) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			w.handle(newLinkEvent(update))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resync compares the attached interfaces with the existing ones, as if a notification was received for each of them.
+func (w *interfaceWatcher) resync() error {
+	ifaces, err := w.listFn()
+	if err != nil {
+		return err
+	}
+	existing := make(map[int]bool)
+	for _, iface := range ifaces {
+		existing[iface.Index] = true
+		w.handle(linkEvent{index: iface.Index, name: iface.Name})
+	}
+	for index, name := range w.attached {
+		if !existing[index] {
+			w.handle(linkEvent{index: index, name: name, deleted: true})
+		}
+	}
+	return nil
+}
+
+// handle detaches the XDP program from deleted or renamed interfaces, and attaches it to new interfaces matching the
+// patterns. Failures are only logged so the other interfaces stay protected.
+func (w *interfaceWatcher) handle(event linkEvent) {
+	interfaceCache.forget(uint32(event.index))
+
+	name, attached := w.attached[event.index]
+	if attached && !event.deleted && name == event.name {
+		return
+	}
+	if attached {
+		delete(w.attached, event.index)
+		if err := w.attacher.Detach(name); err != nil {
+			log.Printf("Error detaching XDP program from %s: %v", name, err)
+		} else {
+			log.Printf("Interface %s deleted or renamed, XDP program detached", name)
+		}
+	}
+	if !event.deleted && matchInterface(w.patterns, event.name) {
+		if err := w.attacher.Attach(net.Interface{Index: event.index, Name: event.name}); err != nil {
+			log.Printf("Error attaching XDP program to %s: %v", event.name, err)
+		} else {
+			w.attached[event.index] = event.name
+			log.Printf("Interface %s appeared, XDP program attached", event.name)
+		}
+	}
+	attachedInterfaces.Set(float64(len(w.attached)))
+}
+
+// matchInterface tells if an interface name matches one of the patterns. Invalid patterns are rejected at startup.
+func matchInterface(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package watchers
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceNames(t *testing.T) {
+	lookups := 0
+	names := newInterfaceNames()
+	names.lookupFn = func(index int) (*net.Interface, error) {
+		lookups++
+		if index == 2 {
+			return &net.Interface{Index: 2, Name: "eth0"}, nil
+		}
+		return nil, errors.New("no such network interface")
+	}
+
+	assert.Equal(t, "eth0", names.name(2))
+	assert.Equal(t, "eth0", names.name(2))
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, "if3", names.name(3))
+}
+
+// fakeAttacher records the interfaces the XDP program is attached to.
+type fakeAttacher struct {
+	attached map[string]bool
+}
+
+func (a *fakeAttacher) Attach(iface net.Interface) error {
+	if iface.Name == "broken0" {
+		return errors.New("device or resource busy")
+	}
+	a.attached[iface.Name] = true
+	return nil
+}
+
+func (a *fakeAttacher) Detach(name string) error {
+	delete(a.attached, name)
+	return nil
+}
+
+func TestInterfaceWatcherHandle(t *testing.T) {
+	testCases := []struct {
+		name     string
+		events   []linkEvent
+		expected map[int]string
+	}{
+		{
+			"Unchanged",
+			[]linkEvent{{index: 2, name: "eth0"}},
+			map[int]string{2: "eth0"},
+		},
+		{
+			"NewMatchingInterface",
+			[]linkEvent{{index: 5, name: "eth1"}},
+			map[int]string{2: "eth0", 5: "eth1"},
+		},
+		{
+			"NewOtherInterface",
+			[]linkEvent{{index: 5, name: "veth1234"}},
+			map[int]string{2: "eth0"},
+		},
+		{
+			"Recreated",
+			[]linkEvent{{index: 2, name: "eth0", deleted: true}, {index: 6, name: "eth0"}},
+			map[int]string{6: "eth0"},
+		},
+		{
+			"RenamedAway",
+			[]linkEvent{{index: 2, name: "old0"}},
+			map[int]string{},
+		},
+		{
+			"AttachFailure",
+			[]linkEvent{{index: 7, name: "broken0"}},
+			map[int]string{2: "eth0"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attacher := &fakeAttacher{attached: map[string]bool{"eth0": true}}
+			w := NewInterfaceWatcher(attacher, []string{"eth*", "broken0"}, []net.Interface{{Index: 2, Name: "eth0"}}).(*interfaceWatcher)
+
+			for _, event := range tc.events {
+				w.handle(event)
+			}
+
+			assert.Equal(t, tc.expected, w.attached)
+			for _, name := range tc.expected {
+				assert.True(t, attacher.attached[name])
+			}
+			assert.Len(t, attacher.attached, len(tc.expected))
+		})
+
+	}
+}
@@ -0,0 +1,59 @@
+package watchers
+
+import (
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// linkUpdatesBuffer is the number of link notifications waiting for the interface watcher.
+const linkUpdatesBuffer = 64
+
+// addrUpdatesBuffer is the number of address notifications waiting for the local address watcher.
+const addrUpdatesBuffer = 64
+
+// linkEvent is a rtnetlink notification about a network interface being created, updated or deleted.
+type linkEvent struct {
+	index   int
+	name    string
+	deleted bool
+}
+
+// newLinkEvent converts a link notification received through netlink.LinkSubscribe.
+func newLinkEvent(update netlink.LinkUpdate) linkEvent {
+	attrs := update.Attrs()
+	return linkEvent{
+		index:   attrs.Index,
+		name:    attrs.Name,
+		deleted: update.Header.Type == unix.RTM_DELLINK,
+	}
+}
+
+// addressEvent is a rtnetlink notification about an address being assigned to or removed from an interface.
+type addressEvent struct {
+	ip      netaddr.IP
+	index   int
+	deleted bool
+}
+
+// newAddressEvent converts an address notification received through netlink.AddrSubscribe. ok is false if the
+// address is not a valid IP.
+func newAddressEvent(update netlink.AddrUpdate) (event addressEvent, ok bool) {
+	ip, ok := netaddr.FromStdIP(update.LinkAddress.IP)
+	return addressEvent{ip: ip, index: update.LinkIndex, deleted: !update.NewAddr}, ok
+}
+
+// listAddresses lists the addresses of all the interfaces, as if a notification was received for each of them.
+func listAddresses() ([]addressEvent, error) {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]addressEvent, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip, ok := netaddr.FromStdIP(addr.IP); ok {
+			events = append(events, addressEvent{ip: ip, index: addr.LinkIndex})
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,80 @@
+package watchers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// linkUpdate builds a link notification for the interface.
+func linkUpdate(messageType uint16, index int, name string) netlink.LinkUpdate {
+	return netlink.LinkUpdate{
+		Header: unix.NlMsghdr{Type: messageType},
+		Link:   &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: index, Name: name}},
+	}
+}
+
+func TestNewLinkEvent(t *testing.T) {
+	testCases := []struct {
+		name     string
+		update   netlink.LinkUpdate
+		expected linkEvent
+	}{
+		{
+			"NewLink",
+			linkUpdate(unix.RTM_NEWLINK, 4, "eth1"),
+			linkEvent{index: 4, name: "eth1"},
+		},
+		{
+			"DeletedLink",
+			linkUpdate(unix.RTM_DELLINK, 12, "veth1234"),
+			linkEvent{index: 12, name: "veth1234", deleted: true},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, newLinkEvent(tc.update))
+		})
+
+	}
+}
+
+func TestNewAddressEvent(t *testing.T) {
+	testCases := []struct {
+		name       string
+		update     netlink.AddrUpdate
+		expected   addressEvent
+		expectedOK bool
+	}{
+		{
+			"NewIPv4Address",
+			netlink.AddrUpdate{LinkAddress: net.IPNet{IP: net.ParseIP("192.0.2.1")}, LinkIndex: 2, NewAddr: true},
+			addressEvent{ip: netaddr.MustParseIP("192.0.2.1"), index: 2},
+			true,
+		},
+		{
+			"DeletedIPv6Address",
+			netlink.AddrUpdate{LinkAddress: net.IPNet{IP: net.ParseIP("2001:db8::1")}, LinkIndex: 3},
+			addressEvent{ip: netaddr.MustParseIP("2001:db8::1"), index: 3, deleted: true},
+			true,
+		},
+		{
+			"InvalidAddress",
+			netlink.AddrUpdate{LinkIndex: 3, NewAddr: true},
+			addressEvent{index: 3},
+			false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			event, ok := newAddressEvent(tc.update)
+			assert.Equal(t, tc.expectedOK, ok)
+			assert.Equal(t, tc.expected, event)
+		})
+
+	}
+}
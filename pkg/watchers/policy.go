@@ -0,0 +1,111 @@
+package watchers
+
+import (
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// BanPolicy decides for how long an IP is banned depending on how many times it was already caught scanning.
+// The offence history is kept in userspace and forgotten once the IP stayed quiet long enough after its last ban.
+type BanPolicy struct {
+	mutex sync.Mutex
+	// durations[i] is the ban duration for the i+1th offence, the last one is reused for subsequent offences.
+	// A duration of 0 means the ban is permanent.
+	durations []time.Duration
+	decay     time.Duration
+	offences  map[netaddr.IP]*offence
+}
+
+type offence struct {
+	count int
+	last  time.Time
+}
+
+func NewBanPolicy(durations []time.Duration, decay time.Duration) *BanPolicy {
+	return &BanPolicy{
+		durations: durations,
+		decay:     decay,
+		offences:  make(map[netaddr.IP]*offence),
+	}
+}
+
+// Offend records a new offence for the IP and returns how many offences it has committed
+// as well as the duration of the resulting ban.
+func (p *BanPolicy) Offend(ip netaddr.IP, now time.Time) (int, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	count := p.nextCount(ip, now)
+	p.offences[ip] = &offence{count: count, last: now}
+
+	return count, p.durationFor(count)
+}
+
+// NextOffence returns what Offend would return without recording the offence, for dry runs.
+func (p *BanPolicy) NextOffence(ip netaddr.IP, now time.Time) (int, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	count := p.nextCount(ip, now)
+	return count, p.durationFor(count)
+}
+
+// BanDuration returns the duration of the current ban of an IP. IPs without history get the shortest ban.
+func (p *BanPolicy) BanDuration(ip netaddr.IP) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	record, ok := p.offences[ip]
+	if !ok {
+		return p.durationFor(1)
+	}
+	return p.durationFor(record.count)
+}
+
+// Forgive drops the offence history of an IP.
+func (p *BanPolicy) Forgive(ip netaddr.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.offences, ip)
+}
+
+// Forget drops the history of IPs that stayed quiet for longer than the decay period after their last ban.
+func (p *BanPolicy) Forget(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for ip, record := range p.offences {
+		if p.decayed(record, now) {
+			delete(p.offences, ip)
+		}
+	}
+}
+
+// nextCount returns the number of offences of an IP once it offends again, starting over if its history decayed.
+func (p *BanPolicy) nextCount(ip netaddr.IP, now time.Time) int {
+	record, ok := p.offences[ip]
+	if !ok || p.decayed(record, now) {
+		return 1
+	}
+	return record.count + 1
+}
+
+// durationFor returns the ban duration for the nth offence.
+func (p *BanPolicy) durationFor(count int) time.Duration {
+	if count > len(p.durations) {
+		count = len(p.durations)
+	}
+	return p.durations[count-1]
+}
+
+// decayed tells if an offence is old enough to be forgotten. Permanent bans never decay.
+func (p *BanPolicy) decayed(record *offence, now time.Time) bool {
+	banDuration := p.durationFor(record.count)
+	if banDuration == 0 {
+		return false
+	}
+	return now.Sub(record.last) > banDuration+p.decay
+}
@@ -0,0 +1,100 @@
+package watchers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestBanPolicyOffend(t *testing.T) {
+	start := time.Unix(1647000000, 0)
+	durations := []time.Duration{10 * time.Minute, time.Hour, 0}
+	testCases := []struct {
+		name      string
+		offences  []time.Duration // offset of each offence since start
+		expected  int
+		banLength time.Duration
+	}{
+		{
+			"FirstOffence",
+			[]time.Duration{0},
+			1,
+			10 * time.Minute,
+		},
+		{
+			"SecondOffence",
+			[]time.Duration{0, 20 * time.Minute},
+			2,
+			time.Hour,
+		},
+		{
+			"PermanentAfterThirdOffence",
+			[]time.Duration{0, 20 * time.Minute, 2 * time.Hour, 48 * time.Hour},
+			4,
+			0,
+		},
+		{
+			"DecayedAfterQuietPeriod",
+			[]time.Duration{0, 25 * time.Hour},
+			1,
+			10 * time.Minute,
+		},
+		{
+			"NotDecayedDuringQuietPeriod",
+			[]time.Duration{0, 24 * time.Hour},
+			2,
+			time.Hour,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := NewBanPolicy(durations, 24*time.Hour)
+			ip := netaddr.IPv4(192, 0, 2, 1)
+
+			var count int
+			var banLength time.Duration
+			for _, offset := range tc.offences {
+				count, banLength = policy.Offend(ip, start.Add(offset))
+			}
+
+			assert.Equal(t, tc.expected, count)
+			assert.Equal(t, tc.banLength, banLength)
+			assert.Equal(t, tc.banLength, policy.BanDuration(ip))
+		})
+
+	}
+}
+
+func TestBanPolicyNextOffence(t *testing.T) {
+	start := time.Unix(1647000000, 0)
+	policy := NewBanPolicy([]time.Duration{10 * time.Minute, time.Hour}, 24*time.Hour)
+	ip := netaddr.IPv4(192, 0, 2, 1)
+
+	for i := 0; i < 3; i++ {
+		count, banLength := policy.NextOffence(ip, start)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 10*time.Minute, banLength)
+	}
+	assert.NotContains(t, policy.offences, ip)
+
+	policy.Offend(ip, start)
+	count, banLength := policy.NextOffence(ip, start.Add(20*time.Minute))
+	assert.Equal(t, 2, count)
+	assert.Equal(t, time.Hour, banLength)
+	assert.Equal(t, 1, policy.offences[ip].count)
+}
+
+func TestBanPolicyForget(t *testing.T) {
+	start := time.Unix(1647000000, 0)
+	policy := NewBanPolicy([]time.Duration{time.Hour}, time.Hour)
+	ip := netaddr.IPv4(192, 0, 2, 1)
+
+	policy.Offend(ip, start)
+	policy.Forget(start.Add(90 * time.Minute))
+	assert.Contains(t, policy.offences, ip)
+
+	policy.Forget(start.Add(3 * time.Hour))
+	assert.NotContains(t, policy.offences, ip)
+}
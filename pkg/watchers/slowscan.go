@@ -0,0 +1,260 @@
+package watchers
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+const (
+	// slowScanHours is the horizon of the slow scan detection, the distinct ports of an IP are counted per hour
+	slowScanHours = 24
+	// maxSlowScanSources is the number of IPs the slow scan detection remembers, the least recently seen ones are
+	// forgotten first. Each IP takes about 1.5kB.
+	maxSlowScanSources = 8192
+	// hllPrecision is the number of hash bits selecting a register, estimates have a standard error of
+	// 1.04/sqrt(2^hllPrecision), about 13%
+	hllPrecision = 6
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates the number of distinct values added to it in constant memory. Each register holds the highest
+// rank, the position of the first set bit, of the hashes it was given.
+type hyperLogLog [hllRegisters]uint8
+
+// add records a hash and tells if the sketch changed.
+func (h *hyperLogLog) add(hash uint64) bool {
+	register := hash >> (64 - hllPrecision)
+	// The register bits are shifted out, the guard bit caps the rank when the remaining bits are all zeros
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank <= h[register] {
+		return false
+	}
+	h[register] = rank
+	return true
+}
+
+// merge adds the values of another sketch to this one.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other {
+		if rank > h[i] {
+			h[i] = rank
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct values added to the sketch.
+func (h *hyperLogLog) estimate() int {
+	var sum float64
+	var zeros int
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	// alpha corrects the bias of the harmonic mean for 64 registers
+	estimate := 0.709 * m * m / sum
+	// Small cardinalities are estimated more accurately from the number of empty registers (linear counting)
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// hashPort hashes a port for the sketches, TCP and UDP ports being distinct. This is the finalizer of splitmix64,
+// which spreads consecutive ports over the whole hash space.
+func hashPort(protocol string, port uint16) uint64 {
+	x := uint64(port)
+	if protocol == protocolUDP {
+		x |= 1 << 16
+	}
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// slowScanSource is the long-horizon history of an IP: one sketch of the distinct ports it contacted per hour.
+type slowScanSource struct {
+	ip       netaddr.IP
+	hours    [slowScanHours]int64 // hour of each sketch, in hours since the epoch
+	sketches [slowScanHours]hyperLogLog
+	lastSeen time.Time
+	// estimate is the distinct ports over the horizon, recomputed only when stale
+	estimate int
+	stale    bool
+}
+
+// SlowScanTracker counts the distinct ports each IP contacted over the last 24 hours, to catch the scans too slow to
+// cross the threshold within a detection window. Memory is bounded: it remembers at most maxSources IPs and forgets
+// the IPs not seen for 24 hours. It is updated by the blocking watcher and saved by the snapshot watcher.
+type SlowScanTracker struct {
+	mutex      sync.Mutex
+	maxSources int
+	sources    map[netaddr.IP]*list.Element
+	// lru holds the slowScanSources, the most recently seen first
+	lru *list.List
+}
+
+// NewSlowScanTracker creates a SlowScanTracker remembering the maxSlowScanSources most recently seen IPs.
+func NewSlowScanTracker() *SlowScanTracker {
+	return newSlowScanTracker(maxSlowScanSources)
+}
+
+func newSlowScanTracker(maxSources int) *SlowScanTracker {
+	return &SlowScanTracker{
+		maxSources: maxSources,
+		sources:    make(map[netaddr.IP]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// add records the TCP and UDP ports an IP contacted and returns the estimated number of distinct ports it contacted
+// over the last 24 hours. Ports seen again are not counted twice.
+func (t *SlowScanTracker) add(ip netaddr.IP, ports, udpPorts []uint16, now time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(now)
+	source := t.source(ip)
+	source.lastSeen = now
+
+	hour := now.Unix() / int64(time.Hour/time.Second)
+	slot := hour % slowScanHours
+	// The slot holds the ports of the same hour a day ago, they are past the horizon
+	if source.hours[slot] != hour {
+		source.hours[slot] = hour
+		source.sketches[slot] = hyperLogLog{}
+		source.stale = true
+	}
+	for _, port := range ports {
+		if source.sketches[slot].add(hashPort(protocolTCP, port)) {
+			source.stale = true
+		}
+	}
+	for _, port := range udpPorts {
+		if source.sketches[slot].add(hashPort(protocolUDP, port)) {
+			source.stale = true
+		}
+	}
+
+	if source.stale {
+		var union hyperLogLog
+		for i := range source.sketches {
+			if source.hours[i] > hour-slowScanHours {
+				union.merge(&source.sketches[i])
+			}
+		}
+		source.estimate = union.estimate()
+		source.stale = false
+	}
+	return source.estimate
+}
+
+// forget drops the history of an IP, for example once it is banned.
+func (t *SlowScanTracker) forget(ip netaddr.IP) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.remove(ip)
+}
+
+// remove drops the history of an IP, the caller holds the mutex.
+func (t *SlowScanTracker) remove(ip netaddr.IP) {
+	if element, ok := t.sources[ip]; ok {
+		t.lru.Remove(element)
+		delete(t.sources, ip)
+	}
+}
+
+// source returns the history of an IP, creating it if needed. The least recently seen IP is forgotten if the tracker
+// is full.
+func (t *SlowScanTracker) source(ip netaddr.IP) *slowScanSource {
+	if element, ok := t.sources[ip]; ok {
+		t.lru.MoveToFront(element)
+		return element.Value.(*slowScanSource)
+	}
+	if t.lru.Len() >= t.maxSources {
+		t.remove(t.lru.Back().Value.(*slowScanSource).ip)
+	}
+	source := &slowScanSource{ip: ip}
+	t.sources[ip] = t.lru.PushFront(source)
+	return source
+}
+
+// prune forgets the IPs not seen for the whole horizon.
+func (t *SlowScanTracker) prune(now time.Time) {
+	for element := t.lru.Back(); element != nil; element = t.lru.Back() {
+		source := element.Value.(*slowScanSource)
+		if now.Sub(source.lastSeen) < slowScanHours*time.Hour {
+			return
+		}
+		t.remove(source.ip)
+	}
+}
+
+// entries returns the history of the IPs seen over the last 24 hours for the snapshot, the most recently seen first.
+func (t *SlowScanTracker) entries(now time.Time) []*slowScanEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(now)
+	hour := now.Unix() / int64(time.Hour/time.Second)
+	entries := make([]*slowScanEntry, 0, t.lru.Len())
+	for element := t.lru.Front(); element != nil; element = element.Next() {
+		source := element.Value.(*slowScanSource)
+		entry := &slowScanEntry{
+			IP:       source.ip.String(),
+			LastSeen: source.lastSeen.UTC(),
+		}
+		for i := range source.sketches {
+			if source.hours[i] > hour-slowScanHours {
+				sketch := source.sketches[i]
+				entry.Hours = append(entry.Hours, slowScanHour{Hour: source.hours[i], Sketch: sketch[:]})
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// restore loads the history of the IPs saved by entries, leaving out what is past the horizon at now.
+func (t *SlowScanTracker) restore(entries []*slowScanEntry, now time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	hour := now.Unix() / int64(time.Hour/time.Second)
+	// The least recently seen IPs are restored first, so they are the first ones forgotten
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		ip, err := netaddr.ParseIP(entry.IP)
+		if err != nil {
+			return err
+		}
+		if now.Sub(entry.LastSeen) >= slowScanHours*time.Hour {
+			continue
+		}
+		source := t.source(ip)
+		source.lastSeen = entry.LastSeen
+		source.stale = true
+		for _, entryHour := range entry.Hours {
+			if len(entryHour.Sketch) != hllRegisters {
+				return fmt.Errorf("invalid sketch for %s: %d registers", entry.IP, len(entryHour.Sketch))
+			}
+			if entryHour.Hour <= hour-slowScanHours || entryHour.Hour > hour {
+				continue
+			}
+			slot := entryHour.Hour % slowScanHours
+			source.hours[slot] = entryHour.Hour
+			copy(source.sketches[slot][:], entryHour.Sketch)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package watchers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	testCases := []struct {
+		name     string
+		distinct int
+	}{
+		{"Empty", 0},
+		{"FewPorts", 10},
+		{"LinearCounting", 100},
+		{"ManyPorts", 5000},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sketch hyperLogLog
+			for i := 0; i < tc.distinct; i++ {
+				sketch.add(hashPort(protocolTCP, uint16(i)))
+				// Values added twice are not counted twice
+				sketch.add(hashPort(protocolTCP, uint16(i)))
+			}
+
+			// Within three standard errors
+			assert.InDelta(t, tc.distinct, sketch.estimate(), 0.4*float64(tc.distinct))
+		})
+
+	}
+}
+
+func TestHashPort(t *testing.T) {
+	assert.NotEqual(t, hashPort(protocolTCP, 53), hashPort(protocolUDP, 53))
+	assert.NotEqual(t, hashPort(protocolTCP, 53), hashPort(protocolTCP, 54))
+	assert.Equal(t, hashPort(protocolUDP, 53), hashPort(protocolUDP, 53))
+}
+
+func TestSlowScanTracker(t *testing.T) {
+	ip := netaddr.IPv4(192, 0, 2, 1)
+	start := time.Date(2022, 3, 11, 12, 0, 0, 0, time.UTC)
+
+	t.Run("OnePortPerHour", func(t *testing.T) {
+		tracker := newSlowScanTracker(10)
+		var estimate int
+		for hour := 0; hour < 20; hour++ {
+			estimate = tracker.add(ip, []uint16{uint16(1000 + hour)}, nil, start.Add(time.Duration(hour)*time.Hour))
+		}
+		assert.InDelta(t, 20, estimate, 4)
+	})
+
+	t.Run("OlderThan24HoursForgotten", func(t *testing.T) {
+		tracker := newSlowScanTracker(10)
+		var estimate int
+		for hour := 0; hour < 48; hour++ {
+			estimate = tracker.add(ip, []uint16{uint16(1000 + hour)}, nil, start.Add(time.Duration(hour)*time.Hour))
+		}
+		assert.InDelta(t, 24, estimate, 4)
+	})
+
+	t.Run("SamePortsNotCountedTwice", func(t *testing.T) {
+		tracker := newSlowScanTracker(10)
+		var estimate int
+		for hour := 0; hour < 24; hour++ {
+			estimate = tracker.add(ip, []uint16{22, 80}, []uint16{53}, start.Add(time.Duration(hour)*time.Hour))
+		}
+		assert.Equal(t, 3, estimate)
+	})
+
+	t.Run("LeastRecentlySeenEvicted", func(t *testing.T) {
+		tracker := newSlowScanTracker(2)
+		other := netaddr.IPv4(192, 0, 2, 2)
+		tracker.add(ip, []uint16{22}, nil, start)
+		tracker.add(other, []uint16{22}, nil, start)
+		tracker.add(ip, []uint16{23}, nil, start)
+		tracker.add(netaddr.IPv4(192, 0, 2, 3), []uint16{22}, nil, start)
+
+		assert.Equal(t, 2, tracker.lru.Len())
+		assert.Contains(t, tracker.sources, ip)
+		assert.NotContains(t, tracker.sources, other)
+	})
+
+	t.Run("QuietIPsPruned", func(t *testing.T) {
+		tracker := newSlowScanTracker(10)
+		tracker.add(ip, []uint16{22}, nil, start)
+		tracker.add(netaddr.IPv4(192, 0, 2, 2), []uint16{22}, nil, start.Add(24*time.Hour))
+
+		assert.NotContains(t, tracker.sources, ip)
+		assert.Equal(t, 1, tracker.lru.Len())
+	})
+
+	t.Run("Forget", func(t *testing.T) {
+		tracker := newSlowScanTracker(10)
+		tracker.add(ip, []uint16{22, 23, 24}, nil, start)
+		tracker.forget(ip)
+
+		assert.Equal(t, 1, tracker.add(ip, []uint16{22}, nil, start))
+	})
+}
@@ -0,0 +1,187 @@
+package watchers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// snapshotVersion is bumped when the snapshot format changes in an incompatible way.
+const snapshotVersion = 1
+
+// snapshot is the on-disk format of the blocklist and of the slow scan history.
+type snapshot struct {
+	Version   int              `json:"version"`
+	Bans      []*snapshotEntry `json:"bans"`
+	SlowScans []*slowScanEntry `json:"slow_scans,omitempty"`
+}
+
+type snapshotEntry struct {
+	IP        string     `json:"ip"`
+	BlockTime time.Time  `json:"block_time"`
+	Duration  string     `json:"duration"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Reason    string     `json:"reason"`
+}
+
+// slowScanEntry is the slow scan history of an IP, see slowScanSource.
+type slowScanEntry struct {
+	IP       string         `json:"ip"`
+	LastSeen time.Time      `json:"last_seen"`
+	Hours    []slowScanHour `json:"hours"`
+}
+
+// slowScanHour is the sketch of the distinct ports an IP contacted during an hour.
+type slowScanHour struct {
+	// Hour is in hours since the epoch
+	Hour int64 `json:"hour"`
+	// Sketch holds the registers of the HyperLogLog sketch, base64 encoded
+	Sketch []byte `json:"sketch"`
+}
+
+// snapshotWatcher periodically writes the Blocklist and the slow scan history to a file, and one last time when the
+// context is cancelled, so they can be restored after a reboot with LoadSnapshot.
+type snapshotWatcher struct {
+	blocklist *Blocklist
+	slowScans *SlowScanTracker
+	path      string
+	period    time.Duration
+}
+
+// NewSnapshotWatcher creates a snapshot watcher, slowScans is nil if slow scan detection is disabled.
+func NewSnapshotWatcher(blocklist *Blocklist, slowScans *SlowScanTracker, path string, period time.Duration) Watcher {
+	return &snapshotWatcher{
+		blocklist: blocklist,
+		slowScans: slowScans,
+		path:      path,
+		period:    period,
+	}
+}
+
+// Run saves the snapshot at every tick until the context is cancelled. Failing to save a snapshot is only logged,
+// the firewall keeps running with the previous snapshot on disk.
+func (w *snapshotWatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.period)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.save(); err != nil {
+				log.Printf("Error saving the blocklist snapshot: %v", err)
+			}
+
+		case <-ctx.Done():
+			log.Println("Stopping snapshot watcher")
+			if err := w.save(); err != nil {
+				log.Printf("Error saving the blocklist snapshot: %v", err)
+			}
+			return nil
+		}
+	}
+}
+
+func (w *snapshotWatcher) save() error {
+	bans, err := w.blocklist.List()
+	if err != nil {
+		return err
+	}
+	return SaveSnapshot(w.path, bans, w.slowScans, time.Now())
+}
+
+// SaveSnapshot writes the bans and the slow scan history at now to a file, slowScans can be nil. The file is replaced
+// atomically so a crash never leaves a partial snapshot.
+func SaveSnapshot(path string, bans []*Ban, slowScans *SlowScanTracker, now time.Time) error {
+	content := snapshot{
+		Version: snapshotVersion,
+		Bans:    make([]*snapshotEntry, 0, len(bans)),
+	}
+	if slowScans != nil {
+		content.SlowScans = slowScans.entries(now)
+	}
+	for _, ban := range bans {
+		entry := &snapshotEntry{
+			IP:        ban.IP.String(),
+			BlockTime: ban.BlockTime.UTC(),
+			Duration:  formatJSONBanDuration(ban.Duration),
+			Reason:    ban.Reason,
+		}
+		if ban.Duration != 0 {
+			expiresAt := ban.BlockTime.Add(ban.Duration).UTC()
+			entry.ExpiresAt = &expiresAt
+		}
+		content.Bans = append(content.Bans, entry)
+	}
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadSnapshot reads the bans saved by SaveSnapshot, leaving out the ones expired at now, and restores the slow scan
+// history in slowScans unless it is nil. A missing file is not an error, there is simply nothing to restore.
+func LoadSnapshot(path string, now time.Time, slowScans *SlowScanTracker) ([]*Ban, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content snapshot
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	if content.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", content.Version)
+	}
+
+	var bans []*Ban
+	for _, entry := range content.Bans {
+		ban, err := parseSnapshotEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	if slowScans != nil {
+		if err := slowScans.restore(content.SlowScans, now); err != nil {
+			return nil, err
+		}
+	}
+	return bans, nil
+}
+
+func parseSnapshotEntry(entry *snapshotEntry) (*Ban, error) {
+	ip, err := netaddr.ParseIP(entry.IP)
+	if err != nil {
+		return nil, err
+	}
+	var duration time.Duration
+	if entry.Duration != formatJSONBanDuration(0) {
+		duration, err = time.ParseDuration(entry.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for %s: %w", entry.IP, err)
+		}
+	}
+	return &Ban{
+		IP:        ip,
+		BlockTime: entry.BlockTime,
+		Duration:  duration,
+		Reason:    entry.Reason,
+	}, nil
+}
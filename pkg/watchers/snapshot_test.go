@@ -0,0 +1,123 @@
+package watchers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"inet.af/netaddr"
+)
+
+func TestSnapshot(t *testing.T) {
+	now := time.Date(2022, 3, 11, 12, 0, 0, 0, time.UTC)
+	permanent := &Ban{
+		IP:        netaddr.IPv4(192, 0, 2, 1),
+		BlockTime: now.Add(-48 * time.Hour),
+		Duration:  0,
+		Reason:    "manual",
+	}
+	ongoing := &Ban{
+		IP:        netaddr.MustParseIP("2001:db8::1"),
+		BlockTime: now.Add(-30 * time.Minute),
+		Duration:  time.Hour,
+		Reason:    reasonPortScan,
+	}
+	expired := &Ban{
+		IP:        netaddr.IPv4(192, 0, 2, 2),
+		BlockTime: now.Add(-2 * time.Hour),
+		Duration:  time.Hour,
+		Reason:    reasonPortScan,
+	}
+
+	testCases := []struct {
+		name     string
+		bans     []*Ban
+		expected []*Ban
+	}{
+		{
+			"Empty",
+			nil,
+			nil,
+		},
+		{
+			"ExpiredBansAreDropped",
+			[]*Ban{permanent, ongoing, expired},
+			[]*Ban{permanent, ongoing},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+
+			require.NoError(t, SaveSnapshot(path, tc.bans, nil, now))
+			bans, err := LoadSnapshot(path, now, nil)
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, bans)
+		})
+
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	testCases := []struct {
+		name          string
+		content       string
+		expectedError bool
+	}{
+		{"MissingFile", "", false},
+		{"InvalidJSON", "{", true},
+		{"UnknownVersion", `{"version": 2, "bans": []}`, true},
+		{"InvalidIP", `{"version": 1, "bans": [{"ip": "192.0.2", "duration": "permanent"}]}`, true},
+		{"InvalidDuration", `{"version": 1, "bans": [{"ip": "192.0.2.1", "duration": "forever"}]}`, true},
+		{"InvalidSlowScanIP", `{"version": 1, "bans": [], "slow_scans": [{"ip": "192.0.2"}]}`, true},
+		{"InvalidSketch", `{"version": 1, "bans": [], "slow_scans": [{"ip": "192.0.2.1", "last_seen": "` + time.Now().Format(time.RFC3339) + `", "hours": [{"hour": 1, "sketch": "AAAA"}]}]}`, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if tc.content != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+			}
+
+			bans, err := LoadSnapshot(path, time.Now(), newSlowScanTracker(10))
+
+			assert.Equal(t, tc.expectedError, err != nil)
+			assert.Empty(t, bans)
+		})
+
+	}
+}
+
+func TestSnapshotSlowScans(t *testing.T) {
+	start := time.Date(2022, 3, 11, 12, 0, 0, 0, time.UTC)
+	scanner := netaddr.IPv4(192, 0, 2, 1)
+	other := netaddr.MustParseIP("2001:db8::1")
+	quiet := netaddr.IPv4(192, 0, 2, 2)
+	tracker := newSlowScanTracker(10)
+	tracker.add(quiet, []uint16{22}, nil, start)
+	for hour := 0; hour < 20; hour++ {
+		tracker.add(scanner, []uint16{uint16(1000 + hour)}, nil, start.Add(time.Duration(hour)*time.Hour))
+	}
+	tracker.add(other, []uint16{22, 80}, []uint16{53}, start.Add(20*time.Hour))
+	expected := tracker.add(scanner, nil, nil, start.Add(20*time.Hour))
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	require.NoError(t, SaveSnapshot(path, nil, tracker, start.Add(20*time.Hour)))
+	// The daemon restarts 10 hours later
+	restored := newSlowScanTracker(10)
+	_, err := LoadSnapshot(path, start.Add(30*time.Hour), restored)
+	require.NoError(t, err)
+
+	// The quiet IP was not seen for 24 hours, and the least recently seen IP is still the first one forgotten
+	assert.NotContains(t, restored.sources, quiet)
+	assert.Equal(t, 2, restored.lru.Len())
+	assert.Equal(t, other, restored.lru.Back().Value.(*slowScanSource).ip)
+	assert.Equal(t, 3, restored.add(other, nil, nil, start.Add(30*time.Hour)))
+	// The first 7 hours of the scanner are past the horizon
+	assert.InDelta(t, 20, expected, 3)
+	assert.InDelta(t, 13, restored.add(scanner, nil, nil, start.Add(30*time.Hour)), 3)
+}
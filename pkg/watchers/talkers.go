@@ -0,0 +1,61 @@
+package watchers
+
+import (
+	"sort"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// Talker is a source IP and the SYN packets it sent during the last detection period.
+type Talker struct {
+	IP     netaddr.IP
+	VLANID uint16
+	SYNs   uint64
+	Ports  int
+}
+
+// TopTalkers keeps the source IPs that sent the most SYN packets during the last detection period. It is updated by
+// the blocking watcher every time it consumes the metric map.
+type TopTalkers struct {
+	mutex   sync.Mutex
+	size    int
+	talkers []Talker
+}
+
+// NewTopTalkers creates a TopTalkers remembering at most size IPs.
+func NewTopTalkers(size int) *TopTalkers {
+	return &TopTalkers{
+		size: size,
+	}
+}
+
+// update replaces the talkers with the ones of the last detection period.
+func (t *TopTalkers) update(talkers []Talker) {
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].SYNs != talkers[j].SYNs {
+			return talkers[i].SYNs > talkers[j].SYNs
+		}
+		return talkers[i].IP.Less(talkers[j].IP)
+	})
+	if len(talkers) > t.size {
+		talkers = talkers[:t.size]
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.talkers = talkers
+}
+
+// List returns up to n talkers sorted by decreasing number of SYN packets.
+func (t *TopTalkers) List(n int) []Talker {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if n > len(t.talkers) || n <= 0 {
+		n = len(t.talkers)
+	}
+	result := make([]Talker, n)
+	copy(result, t.talkers)
+	return result
+}
@@ -0,0 +1,61 @@
+package watchers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"inet.af/netaddr"
+)
+
+func TestTopTalkers(t *testing.T) {
+	first := Talker{IP: netaddr.IPv4(192, 0, 2, 1), SYNs: 300, Ports: 12}
+	second := Talker{IP: netaddr.MustParseIP("2001:db8::1"), VLANID: 100, SYNs: 20, Ports: 1}
+	third := Talker{IP: netaddr.IPv4(192, 0, 2, 2), SYNs: 20, Ports: 2}
+	fourth := Talker{IP: netaddr.IPv4(192, 0, 2, 3), SYNs: 1, Ports: 1}
+
+	testCases := []struct {
+		name     string
+		size     int
+		talkers  []Talker
+		n        int
+		expected []Talker
+	}{
+		{
+			"Empty",
+			10,
+			nil,
+			10,
+			[]Talker{},
+		},
+		{
+			"SortedBySYNsThenIP",
+			10,
+			[]Talker{fourth, second, first, third},
+			10,
+			[]Talker{first, third, second, fourth},
+		},
+		{
+			"Limited",
+			10,
+			[]Talker{fourth, second, first, third},
+			2,
+			[]Talker{first, third},
+		},
+		{
+			"Truncated",
+			3,
+			[]Talker{fourth, second, first, third},
+			0,
+			[]Talker{first, third, second},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			talkers := NewTopTalkers(tc.size)
+			talkers.update(tc.talkers)
+
+			assert.Equal(t, tc.expected, talkers.List(tc.n))
+		})
+
+	}
+}
@@ -3,66 +3,172 @@ package watchers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"log"
-	"time"
+	"os"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/ringbuf"
+	"inet.af/netaddr"
+)
+
+const (
+	// perfBufferSize is the size of the per-CPU buffers used when the kernel does not support ring buffers
+	perfBufferSize = 256 * 1024
 )
 
 var (
-	connectionsReceived = promauto.NewCounter(prometheus.CounterOpts{
+	connectionsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "teleportchallenge_connections_received_total",
-		Help: "The amount of TCP connections received since the start of the application.",
-	})
+		Help: "The amount of TCP connections received since the start of the application, per interface.",
+	}, []string{"interface"})
+	udpFlowsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "teleportchallenge_udp_flows_received_total",
+		Help: "The amount of UDP flows, first datagrams to a port, received since the start of the application, per interface.",
+	}, []string{"interface"})
 )
 
-// trackingWatcher reads the BPF trackingMap and logs all incoming connections.
+// trackingWatcher reads the connection records streamed by the XDP program and logs all incoming connections and UDP
+// flows.
 type trackingWatcher struct {
-	period      time.Duration
-	trackingMap *ebpf.Map
+	connectionsMap *ebpf.Map
+	lostMap        *ebpf.Map
+	events         *EventLogger
+	interfaces     *interfaceNames
+	kernelBans     chan<- netaddr.IP
 }
 
-func NewTrackingWatcher(trackingMap *ebpf.Map, period time.Duration) Watcher {
-	return &trackingWatcher{
-		period:      period,
-		trackingMap: trackingMap,
+// NewTrackingWatcher creates a watcher reading connections from either a ring buffer or a perf event array.
+// It also exposes the amount of connection records the XDP program had to drop, as read from the lostMap.
+// The IPs the XDP program blocked by itself are sent to kernelBans, for the blocking watcher to record the bans.
+func NewTrackingWatcher(connectionsMap, lostMap *ebpf.Map, events *EventLogger, kernelBans chan<- netaddr.IP) Watcher {
+	w := &trackingWatcher{
+		connectionsMap: connectionsMap,
+		lostMap:        lostMap,
+		events:         events,
+		interfaces:     interfaceCache,
+		kernelBans:     kernelBans,
 	}
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "teleportchallenge_connections_lost_total",
+		Help: "The amount of TCP connections the kernel could not log because userspace was too slow to read them.",
+	}, w.countLostConnections))
+	return w
 }
 
-// Run executes printConnections at every tick until the context is cancelled, or if we face an error.
+// Run logs every connection record as soon as it is received until the context is cancelled, or if we face an error.
 func (w *trackingWatcher) Run(ctx context.Context) error {
-	ticker := time.NewTicker(w.period)
+	reader, err := newRecordReader(w.connectionsMap)
+	if err != nil {
+		return err
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			err := w.printConnections()
-			if err != nil {
-				return err
-			}
+	// Read blocks until a record is available, closing the reader is the only way to interrupt it
+	go func() {
+		<-ctx.Done()
+		reader.Close()
+	}()
 
-		case <-ctx.Done():
+	for {
+		rawRecord, err := reader.Read()
+		if errors.Is(err, os.ErrClosed) {
 			log.Println("Stopping tracking watcher")
 			return nil
 		}
+		if err != nil {
+			log.Printf("Error reading connection records: %s", err)
+			return err
+		}
+		if rawRecord == nil {
+			continue
+		}
+		connection, err := w.printConnection(rawRecord)
+		if err != nil {
+			return err
+		}
+		if connection.blocked {
+			select {
+			case w.kernelBans <- connection.sourceIP:
+			case <-ctx.Done():
+			}
+		}
 	}
 }
 
-// printConnections reads all connections from the trackingMap and logs them
-func (w *trackingWatcher) printConnections() error {
-	var rawConnection [12]byte
-	var err error
+// printConnection decodes a connection_record and logs it
+func (w *trackingWatcher) printConnection(rawRecord []byte) (*connectionRecord, error) {
+	var rawConnection [44]byte
 
-	for err = w.trackingMap.LookupAndDelete(nil, &rawConnection); err == nil; err = w.trackingMap.LookupAndDelete(nil, &rawConnection) {
-		connection := unmarshallTCPConnection(rawConnection)
-		log.Printf("New connection: %s", connection)
-		connectionsReceived.Inc()
+	if len(rawRecord) < len(rawConnection) {
+		return nil, fmt.Errorf("failed to parse connection_record: invalid size %d", len(rawRecord))
 	}
-	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
-		log.Printf("Error reading tcp_connection_tracking_map: %s", err)
-		return err
+	copy(rawConnection[:], rawRecord)
+	connection := unmarshallConnectionRecord(rawConnection)
+	connection.iface = w.interfaces.name(connection.ifindex)
+	w.events.logConnection(connection)
+	if connection.protocol == protocolUDP {
+		udpFlowsReceived.WithLabelValues(connection.iface).Inc()
+	} else {
+		connectionsReceived.WithLabelValues(connection.iface).Inc()
+	}
+	return connection, nil
+}
+
+// countLostConnections sums the per-CPU counters of connection records the XDP program could not send.
+func (w *trackingWatcher) countLostConnections() float64 {
+	return sumPerCPUCounter(w.lostMap, "tcp_connection_lost_map")
+}
+
+// recordReader abstracts the ring buffer and perf event array readers.
+type recordReader interface {
+	// Read blocks until a record is available. It returns a nil record if there is nothing to process yet.
+	Read() ([]byte, error)
+	Close() error
+}
+
+// newRecordReader opens a reader matching the type of the connectionsMap.
+func newRecordReader(connectionsMap *ebpf.Map) (recordReader, error) {
+	if connectionsMap.Type() == ebpf.RingBuf {
+		reader, err := ringbuf.NewReader(connectionsMap)
+		if err != nil {
+			return nil, err
+		}
+		return &ringbufReader{reader}, nil
+	}
+	reader, err := perf.NewReader(connectionsMap, perfBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &perfReader{reader}, nil
+}
+
+type ringbufReader struct {
+	*ringbuf.Reader
+}
+
+func (r *ringbufReader) Read() ([]byte, error) {
+	record, err := r.Reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	return record.RawSample, nil
+}
+
+type perfReader struct {
+	*perf.Reader
+}
+
+func (r *perfReader) Read() ([]byte, error) {
+	record, err := r.Reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	// Records lost in the perf buffer are already counted by the XDP program in tcp_connection_lost_map
+	if record.LostSamples > 0 {
+		return nil, nil
 	}
-	return nil
+	return record.RawSample, nil
 }
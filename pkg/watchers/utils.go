@@ -4,80 +4,325 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
 
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
 )
 
+// hostEndian is the byte order of the host, followed by the values the BPF program computes itself.
+var hostEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		hostEndian = binary.BigEndian
+	}
+}
+
+// portHistorySize is the number of ports kept for each IP, see PORT_HISTORY_SIZE in types.h.
+const portHistorySize = 10
+
+// MaxPortThreshold is the highest port scan threshold. An IP is banned when it contacts more ports than the threshold,
+// and no more than portHistorySize ports of an IP are known at once.
+const MaxPortThreshold = portHistorySize - 1
+
+// ipMetricSize is the size of an ip_metric: syn_received, vlan_id, the ports, scan_types, 1 byte of padding,
+// port_seen, the UDP ports, 4 bytes of padding, udp_port_seen, ifindex and 4 bytes of padding.
+const ipMetricSize = 8 + 2 + 2*portHistorySize + 1 + 1 + 8*portHistorySize + 2*portHistorySize + 4 + 8*portHistorySize + 4 + 4
+
+// Offsets of the port histories in an ip_metric
+const (
+	portsOffset       = 10
+	portSeenOffset    = portsOffset + 2*portHistorySize + 2
+	udpPortsOffset    = portSeenOffset + 8*portHistorySize
+	udpPortSeenOffset = udpPortsOffset + 2*portHistorySize + 4
+	ifindexOffset     = udpPortSeenOffset + 8*portHistorySize
+)
+
+// Scan techniques, as recorded in ip_metric.scan_types
+const (
+	scanSYN  = 0x01
+	scanFIN  = 0x02
+	scanNULL = 0x04
+	scanXmas = 0x08
+	scanACK  = 0x10
+	// scanUDP is set once the IP sent a datagram to a UDP port, it is not a TCP scan technique
+	scanUDP = 0x20
+)
+
+// Protocols of the connection records, as logged
+const (
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+// scanTypeNames are the names of the scan techniques, in the order they are reported.
+var scanTypeNames = []struct {
+	scanType uint8
+	name     string
+}{
+	{scanSYN, "SYN"},
+	{scanFIN, "FIN"},
+	{scanNULL, "NULL"},
+	{scanXmas, "Xmas"},
+	{scanACK, "ACK"},
+}
+
+// defaultEphemeralPorts is the default Linux local port range, used when it cannot be read from procfs.
+var defaultEphemeralPorts = [2]uint16{32768, 60999}
+
 type ipMetric struct {
 	synReceived uint64
-	ports       map[uint16]bool // this map acts as a set
+	vlanID      uint16            // VLAN the IP was last seen on, 0 if untagged
+	ports       map[uint16]uint64 // last time each port was contacted, in nanoseconds since boot
+	scanTypes   uint8             // techniques used to probe the ports, a combination of the scan* flags
+	udpPorts    map[uint16]uint64 // last time each UDP port was sent a datagram, in nanoseconds since boot
+	ifindex     uint32            // index of the interface the IP was last seen on
+	iface       string            // name of the interface, resolved from ifindex by the blocking watcher
 }
 
 // unmarshalIPMetric converts an eBPF ip_metric into an ipMetric go struct.
 func unmarshalIPMetric(data []byte) (*ipMetric, error) {
-	if (len(data) < 10) || (len(data)%2 == 1) {
+	if len(data) < ipMetricSize {
 		return nil, errors.New("failed to parse ip_metric: invalid size")
 	}
 
 	// Danger: Endianness is tricky and varies from the information source.
-	// synReceived is computed locally thus it follows host endianness, usually little-endian. Uvarint will work anyway.
-	synReceived, _ := binary.Uvarint(data[:8])
-	numPorts := (len(data) - 8) / 2
-
-	ports := make(map[uint16]bool)
-
-	for i := 0; i < numPorts; i++ {
-		// ports are bytes copied directly from "the wire", thus they follow network endianess, which is big-endian
-		port := binary.BigEndian.Uint16(data[8+2*i : 10+2*i])
-		if port != 0 {
-			ports[port] = true
-		}
-	}
+	// synReceived is computed locally thus it follows host endianness
+	synReceived := hostEndian.Uint64(data[:8])
+	// vlanID is copied directly from "the wire", thus it follows network endianness
+	vlanID := binary.BigEndian.Uint16(data[8:10])
+	scanTypes := data[portsOffset+2*portHistorySize]
+	ifindex := hostEndian.Uint32(data[ifindexOffset : ifindexOffset+4])
 
 	result := ipMetric{
 		synReceived: synReceived,
-		ports:       ports,
+		vlanID:      vlanID,
+		ports:       unmarshalPortHistory(data, portsOffset, portSeenOffset),
+		scanTypes:   scanTypes,
+		udpPorts:    unmarshalPortHistory(data, udpPortsOffset, udpPortSeenOffset),
+		ifindex:     ifindex,
 	}
 
 	return &result, nil
 }
 
+// unmarshalPortHistory reads the ports of an ip_metric and the last time they were contacted, starting at the given
+// offsets.
+func unmarshalPortHistory(data []byte, portsOffset, seenOffset int) map[uint16]uint64 {
+	ports := make(map[uint16]uint64)
+
+	for i := 0; i < portHistorySize; i++ {
+		// ports are bytes copied directly from "the wire", thus they follow network endianess, which is big-endian
+		port := binary.BigEndian.Uint16(data[portsOffset+2*i : portsOffset+2*i+2])
+		// timestamps are computed locally
+		seen := hostEndian.Uint64(data[seenOffset+8*i : seenOffset+8*i+8])
+		// Empty slots were never seen
+		if seen != 0 {
+			ports[port] = seen
+		}
+	}
+	return ports
+}
+
 // mergeIPMetric merge ipMetric coming from different CPUs into a single one
 func mergeIPMetric(metrics []*ipMetric) *ipMetric {
 	result := ipMetric{
 		synReceived: 0,
-		ports:       make(map[uint16]bool),
+		ports:       make(map[uint16]uint64),
+		udpPorts:    make(map[uint16]uint64),
 	}
 	for _, cpuMetric := range metrics {
 		result.synReceived += cpuMetric.synReceived
-		for port := range cpuMetric.ports {
-			result.ports[port] = true
+		// An IP is rarely seen on several VLANs, we keep the first one
+		if result.vlanID == 0 {
+			result.vlanID = cpuMetric.vlanID
 		}
+		if result.ifindex == 0 {
+			result.ifindex = cpuMetric.ifindex
+		}
+		result.scanTypes |= cpuMetric.scanTypes
+		// A port contacted through several CPUs keeps its most recent time
+		mergePortHistory(result.ports, cpuMetric.ports)
+		mergePortHistory(result.udpPorts, cpuMetric.udpPorts)
 	}
 
 	return &result
 }
 
-type tcpConnection struct {
+// mergePortHistory merges the ports of a CPU into ports, a port contacted through several CPUs keeps its most recent
+// time.
+func mergePortHistory(ports, cpuPorts map[uint16]uint64) {
+	for port, seen := range cpuPorts {
+		if seen > ports[port] {
+			ports[port] = seen
+		}
+	}
+}
+
+// portsSince returns the TCP ports contacted since the given time, in nanoseconds since boot, sorted.
+func (m *ipMetric) portsSince(since uint64) []uint16 {
+	return portsSince(m.ports, since)
+}
+
+// udpPortsSince returns the UDP ports contacted since the given time, in nanoseconds since boot, sorted.
+func (m *ipMetric) udpPortsSince(since uint64) []uint16 {
+	return portsSince(m.udpPorts, since)
+}
+
+// portsSince returns the ports of a port history contacted since the given time, sorted.
+func portsSince(history map[uint16]uint64, since uint64) []uint16 {
+	var ports []uint16
+	for port, seen := range history {
+		if seen >= since {
+			ports = append(ports, port)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// formatScanTypes returns the names of the scan techniques of a scan_types combination.
+func formatScanTypes(scanTypes uint8) []string {
+	var names []string
+	for _, scanType := range scanTypeNames {
+		if scanTypes&scanType.scanType != 0 {
+			names = append(names, scanType.name)
+		}
+	}
+	return names
+}
+
+// parsePortRange parses a port range as found in /proc/sys/net/ipv4/ip_local_port_range: two ports separated by
+// whitespace.
+func parsePortRange(raw string) ([2]uint16, error) {
+	var portRange [2]uint16
+	fields := strings.Fields(raw)
+	if len(fields) != 2 {
+		return portRange, fmt.Errorf("invalid port range %q", raw)
+	}
+	for i, field := range fields {
+		port, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return portRange, fmt.Errorf("invalid port range %q: %w", raw, err)
+		}
+		portRange[i] = uint16(port)
+	}
+	if portRange[0] > portRange[1] {
+		return portRange, fmt.Errorf("invalid port range %q", raw)
+	}
+	return portRange, nil
+}
+
+// monotonicNow returns the time elapsed since boot in nanoseconds, the clock of bpf_ktime_get_ns.
+func monotonicNow() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// sumPerCPUCounter sums the per-CPU values of the single entry of a counter map, name is only used for logging.
+func sumPerCPUCounter(counterMap *ebpf.Map, name string) float64 {
+	var perCPUCounter []uint64
+
+	if err := counterMap.Lookup(uint32(0), &perCPUCounter); err != nil {
+		log.Printf("Error reading %s: %s", name, err)
+		return 0
+	}
+	var sum uint64
+	for _, cpuCounter := range perCPUCounter {
+		sum += cpuCounter
+	}
+	return float64(sum)
+}
+
+// connectionRecord is a TCP connection attempt or the first datagram of a UDP flow, see connection_record in types.h.
+type connectionRecord struct {
 	sourceIP   netaddr.IP
 	destIP     netaddr.IP
 	sourcePort uint16
 	destPort   uint16
+	vlanID     uint16
+	blocked    bool   // the SYN made the XDP program block the source IP
+	protocol   string // protocolTCP, or protocolUDP for the first datagram of a UDP flow
+	ifindex    uint32
+	iface      string // name of the interface, resolved from ifindex by the tracking watcher
+}
+
+func (c *connectionRecord) String() string {
+	return fmt.Sprintf("%s -> %s%s", netaddr.IPPortFrom(c.sourceIP, c.sourcePort), netaddr.IPPortFrom(c.destIP, c.destPort), formatVLAN(c.vlanID))
+}
+
+// formatVLAN returns a VLAN suffix for log lines, or nothing for untagged traffic.
+func formatVLAN(vlanID uint16) string {
+	if vlanID == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (vlan %d)", vlanID)
 }
 
-func (c *tcpConnection) String() string {
-	return fmt.Sprintf("%s:%d -> %s:%d", c.sourceIP, c.sourcePort, c.destIP, c.destPort)
+// unmarshalIP converts an eBPF ip_address into a netaddr.IP. IPv4-mapped addresses are converted back to IPv4.
+func unmarshalIP(data [16]byte) netaddr.IP {
+	return netaddr.IPFrom16(data).Unmap()
 }
 
-func unmarshallTCPConnection(data [12]byte) *tcpConnection {
-	sourceIP := netaddr.IPFrom4([4]byte{data[0], data[1], data[2], data[3]})
-	destIP := netaddr.IPFrom4([4]byte{data[4], data[5], data[6], data[7]})
-	sourcePort := binary.BigEndian.Uint16(data[8:10])
-	destPort := binary.BigEndian.Uint16(data[10:12])
-	return &tcpConnection{
-		sourceIP:   sourceIP,
-		destIP:     destIP,
+// marshalIP converts a netaddr.IP into an eBPF ip_address. IPv4 addresses are converted to IPv4-mapped addresses.
+func marshalIP(ip netaddr.IP) [16]byte {
+	return ip.As16()
+}
+
+// unmarshalSweepKey converts an eBPF sweep_key into its source and destination IPs.
+func unmarshalSweepKey(data [32]byte) (netaddr.IP, netaddr.IP) {
+	var sourceIP, destIP [16]byte
+	copy(sourceIP[:], data[0:16])
+	copy(destIP[:], data[16:32])
+	return unmarshalIP(sourceIP), unmarshalIP(destIP)
+}
+
+// marshalSweepKey converts a source and a destination IP into an eBPF sweep_key.
+func marshalSweepKey(sourceIP, destIP netaddr.IP) [32]byte {
+	var data [32]byte
+	source, dest := marshalIP(sourceIP), marshalIP(destIP)
+	copy(data[0:16], source[:])
+	copy(data[16:32], dest[:])
+	return data
+}
+
+// sortIPs sorts IPs in place, IPv4 addresses first.
+func sortIPs(ips []netaddr.IP) {
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Less(ips[j]) })
+}
+
+func unmarshallConnectionRecord(data [44]byte) *connectionRecord {
+	var sourceIP, destIP [16]byte
+	copy(sourceIP[:], data[0:16])
+	copy(destIP[:], data[16:32])
+	sourcePort := binary.BigEndian.Uint16(data[32:34])
+	destPort := binary.BigEndian.Uint16(data[34:36])
+	vlanID := binary.BigEndian.Uint16(data[36:38])
+	blocked := data[38] != 0
+	protocol := protocolTCP
+	if data[39] == unix.IPPROTO_UDP {
+		protocol = protocolUDP
+	}
+	// ifindex is computed locally thus it follows host endianness
+	ifindex := hostEndian.Uint32(data[40:44])
+	return &connectionRecord{
+		sourceIP:   unmarshalIP(sourceIP),
+		destIP:     unmarshalIP(destIP),
 		sourcePort: sourcePort,
 		destPort:   destPort,
+		vlanID:     vlanID,
+		blocked:    blocked,
+		protocol:   protocol,
+		ifindex:    ifindex,
 	}
 }
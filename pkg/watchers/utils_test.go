@@ -1,89 +1,367 @@
 package watchers
 
 import (
+	"encoding/binary"
 	"testing"
 
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
 	"github.com/stretchr/testify/assert"
 	"inet.af/netaddr"
 )
 
+// newTestMap creates a BPF map for the test, or skips the test if the process is not allowed to create BPF maps.
+func newTestMap(t *testing.T, spec *ebpf.MapSpec) *ebpf.Map {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		t.Skipf("Removing the memlock limit: %v", err)
+	}
+	m, err := ebpf.NewMap(spec)
+	if err != nil {
+		t.Skipf("Creating a BPF map: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+// marshalIPMetric builds an ip_metric as the BPF program stores it on a little-endian host.
+func marshalIPMetric(synReceived uint64, vlanID uint16, ports []uint16, seen []uint64) []byte {
+	data := make([]byte, ipMetricSize)
+	binary.LittleEndian.PutUint64(data[:8], synReceived)
+	binary.BigEndian.PutUint16(data[8:10], vlanID)
+	for i, port := range ports {
+		binary.BigEndian.PutUint16(data[10+2*i:12+2*i], port)
+	}
+	for i, s := range seen {
+		binary.LittleEndian.PutUint64(data[32+8*i:40+8*i], s)
+	}
+	return data
+}
+
 func TestUnmarshallIPMetric(t *testing.T) {
+	if hostEndian != binary.LittleEndian {
+		t.Skip("test data is little-endian")
+	}
 	testCases := []struct {
-		name     string
-		data     []byte
-		expected *ipMetric
+		name          string
+		data          []byte
+		expected      *ipMetric
+		expectedError bool
 	}{
 		{
 			"SingleCall1Port",
-			[]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 80},
+			marshalIPMetric(1, 0, []uint16{80}, []uint64{1000}),
 			&ipMetric{
 				synReceived: 1,
-				ports:       map[uint16]bool{80: true},
+				ports:       map[uint16]uint64{80: 1000},
+				udpPorts:    map[uint16]uint64{},
 			},
+			false,
 		},
 		{
-			"DoubleCall10Port",
-			[]byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 82, 0, 81, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			"DoubleCall2Ports",
+			marshalIPMetric(2, 0, []uint16{82, 81}, []uint64{2000, 1000}),
 			&ipMetric{
 				synReceived: 2,
-				ports:       map[uint16]bool{81: true, 82: true},
+				ports:       map[uint16]uint64{81: 1000, 82: 2000},
+				udpPorts:    map[uint16]uint64{},
 			},
+			false,
 		},
 		{
-			"4Calls3PortsWithEmpty",
-			[]byte{4, 0, 0, 0, 0, 0, 0, 0, 31, 150, 31, 146, 0, 0, 31, 144},
+			"FullHistory",
+			marshalIPMetric(10, 0,
+				[]uint16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+				[]uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}),
+			&ipMetric{
+				synReceived: 10,
+				ports:       map[uint16]uint64{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 10: 10},
+				udpPorts:    map[uint16]uint64{},
+			},
+			false,
+		},
+		{
+			"EmptySlotsIgnored",
+			marshalIPMetric(4, 0, []uint16{8086, 8082, 0, 8080}, []uint64{4, 3, 0, 1}),
 			&ipMetric{
 				synReceived: 4,
-				ports:       map[uint16]bool{8086: true, 8082: true, 8080: true},
+				ports:       map[uint16]uint64{8086: 4, 8082: 3, 8080: 1},
+				udpPorts:    map[uint16]uint64{},
+			},
+			false,
+		},
+		{
+			"ManySYNs",
+			marshalIPMetric(300, 0, []uint16{22}, []uint64{1}),
+			&ipMetric{
+				synReceived: 300,
+				ports:       map[uint16]uint64{22: 1},
+				udpPorts:    map[uint16]uint64{},
+			},
+			false,
+		},
+		{
+			"VLANTagged",
+			marshalIPMetric(1, 100, []uint16{22}, []uint64{1}),
+			&ipMetric{
+				synReceived: 1,
+				vlanID:      100,
+				ports:       map[uint16]uint64{22: 1},
+				udpPorts:    map[uint16]uint64{},
+			},
+			false,
+		},
+		{
+			"StealthScan",
+			func() []byte {
+				data := marshalIPMetric(0, 0, []uint16{22}, []uint64{1})
+				data[30] = scanFIN | scanXmas
+				return data
+			}(),
+			&ipMetric{
+				ports:     map[uint16]uint64{22: 1},
+				scanTypes: scanFIN | scanXmas,
+				udpPorts:  map[uint16]uint64{},
+			},
+			false,
+		},
+		{
+			"UDPPorts",
+			func() []byte {
+				data := marshalIPMetric(0, 0, nil, nil)
+				data[30] = scanUDP
+				binary.BigEndian.PutUint16(data[112:114], 53)
+				binary.BigEndian.PutUint16(data[114:116], 161)
+				binary.LittleEndian.PutUint64(data[136:144], 5)
+				binary.LittleEndian.PutUint64(data[144:152], 6)
+				return data
+			}(),
+			&ipMetric{
+				ports:     map[uint16]uint64{},
+				scanTypes: scanUDP,
+				udpPorts:  map[uint16]uint64{53: 5, 161: 6},
 			},
+			false,
+		},
+		{
+			"Interface",
+			func() []byte {
+				data := marshalIPMetric(1, 0, []uint16{22}, []uint64{1})
+				binary.LittleEndian.PutUint32(data[216:220], 2)
+				return data
+			}(),
+			&ipMetric{
+				synReceived: 1,
+				ports:       map[uint16]uint64{22: 1},
+				udpPorts:    map[uint16]uint64{},
+				ifindex:     2,
+			},
+			false,
+		},
+		{
+			"Truncated",
+			[]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 80},
+			nil,
+			true,
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, _ := unmarshalIPMetric(tc.data)
+			result, err := unmarshalIPMetric(tc.data)
 
+			assert.Equal(t, tc.expectedError, err != nil)
 			assert.Equal(t, tc.expected, result)
 		})
 
 	}
 }
 
-func TestUnmarshallTCPConnection(t *testing.T) {
+func TestPortsSince(t *testing.T) {
+	metric := &ipMetric{
+		ports: map[uint16]uint64{22: 100, 80: 200, 443: 300, 8080: 50},
+	}
+	testCases := []struct {
+		name     string
+		since    uint64
+		expected []uint16
+	}{
+		{"AllPorts", 0, []uint16{22, 80, 443, 8080}},
+		{"WindowBoundaryIncluded", 200, []uint16{80, 443}},
+		{"NoPort", 301, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, metric.portsSince(tc.since))
+		})
+
+	}
+}
+
+func TestUnmarshallConnectionRecord(t *testing.T) {
 	testCases := []struct {
 		name     string
-		data     [12]byte
-		expected *tcpConnection
+		data     [44]byte
+		expected *connectionRecord
 	}{
 		{
 			"LocalhostToLocalhost",
-			[12]byte{127, 0, 0, 1, 127, 0, 0, 1, 139, 98, 31, 148},
-			&tcpConnection{
+			[44]byte{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 127, 0, 0, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 127, 0, 0, 1,
+				139, 98, 31, 148,
+				0, 0, 0, 6,
+				1, 0, 0, 0,
+			},
+			&connectionRecord{
 				sourceIP:   netaddr.IPv4(127, 0, 0, 1),
 				destIP:     netaddr.IPv4(127, 0, 0, 1),
 				sourcePort: 35682,
 				destPort:   8084,
+				protocol:   protocolTCP,
+				ifindex:    1,
 			},
 		},
 		{
 			"NullSourceIP",
-			[12]byte{0, 0, 0, 0, 127, 0, 0, 1, 139, 98, 31, 148},
-			&tcpConnection{
+			[44]byte{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 127, 0, 0, 1,
+				139, 98, 31, 148,
+				0, 0, 0, 6,
+				0, 0, 0, 0,
+			},
+			&connectionRecord{
 				sourceIP:   netaddr.IPv4(0, 0, 0, 0),
 				destIP:     netaddr.IPv4(127, 0, 0, 1),
 				sourcePort: 35682,
 				destPort:   8084,
+				protocol:   protocolTCP,
+			},
+		},
+		{
+			"VLANTagged",
+			[44]byte{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 2,
+				139, 98, 0, 22,
+				0x0f, 0xff, 0, 6,
+				2, 0, 0, 0,
+			},
+			&connectionRecord{
+				sourceIP:   netaddr.IPv4(192, 0, 2, 1),
+				destIP:     netaddr.IPv4(192, 0, 2, 2),
+				sourcePort: 35682,
+				destPort:   22,
+				protocol:   protocolTCP,
+				vlanID:     4095,
+				ifindex:    2,
+			},
+		},
+		{
+			"Blocked",
+			[44]byte{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 2,
+				139, 98, 0, 23,
+				0, 0, 1, 6,
+				2, 0, 0, 0,
+			},
+			&connectionRecord{
+				sourceIP:   netaddr.IPv4(192, 0, 2, 1),
+				destIP:     netaddr.IPv4(192, 0, 2, 2),
+				sourcePort: 35682,
+				destPort:   23,
+				protocol:   protocolTCP,
+				blocked:    true,
+				ifindex:    2,
+			},
+		},
+		{
+			"UDPFlow",
+			[44]byte{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 255, 192, 0, 2, 2,
+				139, 98, 0, 53,
+				0, 0, 0, 17,
+				2, 0, 0, 0,
+			},
+			&connectionRecord{
+				sourceIP:   netaddr.IPv4(192, 0, 2, 1),
+				destIP:     netaddr.IPv4(192, 0, 2, 2),
+				sourcePort: 35682,
+				destPort:   53,
+				protocol:   protocolUDP,
+				ifindex:    2,
+			},
+		},
+		{
+			"IPv6",
+			[44]byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				139, 98, 1, 187,
+				0, 0, 0, 6,
+				0, 0, 0, 0,
+			},
+			&connectionRecord{
+				sourceIP:   netaddr.MustParseIP("2001:db8::1"),
+				destIP:     netaddr.MustParseIP("::1"),
+				sourcePort: 35682,
+				destPort:   443,
+				protocol:   protocolTCP,
 			},
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := unmarshallTCPConnection(tc.data)
+			result := unmarshallConnectionRecord(tc.data)
 
 			assert.Equal(t, tc.expected, result)
 		})
 
 	}
 }
+
+func TestMarshalIP(t *testing.T) {
+	testCases := []struct {
+		name string
+		ip   netaddr.IP
+	}{
+		{"IPv4", netaddr.IPv4(192, 0, 2, 1)},
+		{"IPv6", netaddr.MustParseIP("2001:db8::1")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := unmarshalIP(marshalIP(tc.ip))
+
+			assert.Equal(t, tc.ip, result)
+		})
+
+	}
+}
+
+func TestSweepKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sourceIP netaddr.IP
+		destIP   netaddr.IP
+	}{
+		{"IPv4", netaddr.IPv4(192, 0, 2, 1), netaddr.IPv4(198, 51, 100, 7)},
+		{"IPv6", netaddr.MustParseIP("2001:db8::1"), netaddr.MustParseIP("2001:db8:1::22")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := marshalSweepKey(tc.sourceIP, tc.destIP)
+			sourceIP, destIP := unmarshalSweepKey(key)
+
+			assert.Equal(t, tc.sourceIP, sourceIP)
+			assert.Equal(t, tc.destIP, destIP)
+			// IPv4 addresses are stored as IPv4-mapped addresses, like the XDP program does
+			assert.Equal(t, marshalIP(tc.destIP), *(*[16]byte)(key[16:32]))
+		})
+
+	}
+}
+
 func TestMergeIPMetric(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -94,71 +372,176 @@ func TestMergeIPMetric(t *testing.T) {
 			"NotInitializedIPMetric",
 			[]*ipMetric{},
 			&ipMetric{
-				0,
-				map[uint16]bool{},
+				synReceived: 0,
+				vlanID:      0,
+				ports:       map[uint16]uint64{},
+				udpPorts:    map[uint16]uint64{},
 			},
 		},
 		{
 			"SingleIPMetric",
 			[]*ipMetric{
 				{
-					65,
-					map[uint16]bool{
-						80: true, 8080: true,
+					synReceived: 65,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						80: 1, 8080: 1,
 					},
 				},
 			},
 			&ipMetric{
-				65,
-				map[uint16]bool{
-					80: true, 8080: true,
+				synReceived: 65,
+				vlanID:      0,
+				ports: map[uint16]uint64{
+					80: 1, 8080: 1,
 				},
+				udpPorts: map[uint16]uint64{},
 			},
 		},
 		{
 			"TwoIdenticalIPMetric",
 			[]*ipMetric{
 				{
-					65,
-					map[uint16]bool{
-						80: true, 8080: true,
+					synReceived: 65,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						80: 1, 8080: 1,
 					},
 				},
 				{
-					65,
-					map[uint16]bool{
-						80: true, 8080: true,
+					synReceived: 65,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						80: 1, 8080: 1,
 					},
 				},
 			},
 			&ipMetric{
-				130,
-				map[uint16]bool{
-					80: true, 8080: true,
+				synReceived: 130,
+				vlanID:      0,
+				ports: map[uint16]uint64{
+					80: 1, 8080: 1,
 				},
+				udpPorts: map[uint16]uint64{},
 			},
 		},
 		{
 			"TwoDifferentIPMetric",
 			[]*ipMetric{
 				{
-					65,
-					map[uint16]bool{
-						80: true, 8080: true,
+					synReceived: 65,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						80: 1, 8080: 1,
+					},
+				},
+				{
+					synReceived: 65,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						443: 1, 8443: 1,
+					},
+				},
+			},
+			&ipMetric{
+				synReceived: 130,
+				vlanID:      0,
+				ports: map[uint16]uint64{
+					80: 1, 443: 1, 8080: 1, 8443: 1,
+				},
+				udpPorts: map[uint16]uint64{},
+			},
+		},
+		{
+			"SamePortOnTwoCPUs",
+			[]*ipMetric{
+				{
+					synReceived: 1,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						22: 100,
 					},
 				},
 				{
-					65,
-					map[uint16]bool{
-						443: true, 8443: true,
+					synReceived: 1,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						22: 200,
 					},
 				},
 			},
 			&ipMetric{
-				130,
-				map[uint16]bool{
-					80: true, 443: true, 8080: true, 8443: true,
+				synReceived: 2,
+				vlanID:      0,
+				ports: map[uint16]uint64{
+					22: 200,
 				},
+				udpPorts: map[uint16]uint64{},
+			},
+		},
+		{
+			"ScanTypesCombined",
+			[]*ipMetric{
+				{synReceived: 1, ports: map[uint16]uint64{22: 1}, scanTypes: scanSYN},
+				{ports: map[uint16]uint64{23: 1}, scanTypes: scanACK},
+			},
+			&ipMetric{
+				synReceived: 1,
+				ports:       map[uint16]uint64{22: 1, 23: 1},
+				scanTypes:   scanSYN | scanACK,
+				udpPorts:    map[uint16]uint64{},
+			},
+		},
+		{
+			"UDPPortsOnTwoCPUs",
+			[]*ipMetric{
+				{ports: map[uint16]uint64{22: 1}, udpPorts: map[uint16]uint64{53: 100}, scanTypes: scanSYN | scanUDP},
+				{udpPorts: map[uint16]uint64{53: 200, 161: 150}, scanTypes: scanUDP},
+			},
+			&ipMetric{
+				ports:     map[uint16]uint64{22: 1},
+				udpPorts:  map[uint16]uint64{53: 200, 161: 150},
+				scanTypes: scanSYN | scanUDP,
+			},
+		},
+		{
+			"UntaggedAndTaggedIPMetric",
+			[]*ipMetric{
+				{
+					synReceived: 1,
+					vlanID:      0,
+					ports: map[uint16]uint64{
+						22: 1,
+					},
+				},
+				{
+					synReceived: 1,
+					vlanID:      100,
+					ports: map[uint16]uint64{
+						23: 1,
+					},
+				},
+			},
+			&ipMetric{
+				synReceived: 2,
+				vlanID:      100,
+				ports: map[uint16]uint64{
+					22: 1, 23: 1,
+				},
+				udpPorts: map[uint16]uint64{},
+			},
+		},
+		{
+			"InterfaceOnOneCPU",
+			[]*ipMetric{
+				{synReceived: 1, ports: map[uint16]uint64{22: 1}},
+				{synReceived: 1, ports: map[uint16]uint64{23: 1}, ifindex: 2},
+			},
+			&ipMetric{
+				synReceived: 2,
+				ports:       map[uint16]uint64{22: 1, 23: 1},
+				udpPorts:    map[uint16]uint64{},
+				ifindex:     2,
 			},
 		},
 	}
@@ -171,3 +554,45 @@ func TestMergeIPMetric(t *testing.T) {
 
 	}
 }
+
+func TestFormatScanTypes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		scanTypes uint8
+		expected  []string
+	}{
+		{"Unknown", 0, nil},
+		{"SYN", scanSYN, []string{"SYN"}},
+		{"Stealth", scanNULL | scanFIN | scanXmas | scanACK, []string{"FIN", "NULL", "Xmas", "ACK"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, formatScanTypes(tc.scanTypes))
+		})
+
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	testCases := []struct {
+		name          string
+		raw           string
+		expected      [2]uint16
+		expectedError bool
+	}{
+		{"Default", "32768\t60999\n", [2]uint16{32768, 60999}, false},
+		{"Spaces", "1024 65535", [2]uint16{1024, 65535}, false},
+		{"SinglePort", "32768", [2]uint16{}, true},
+		{"OutOfRange", "32768 65536", [2]uint16{32768, 0}, true},
+		{"Reversed", "60999 32768", [2]uint16{60999, 32768}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parsePortRange(tc.raw)
+
+			assert.Equal(t, tc.expectedError, err != nil)
+			assert.Equal(t, tc.expected, result)
+		})
+
+	}
+}